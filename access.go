@@ -0,0 +1,110 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+//accessRules map path prefixes to who may access them, longest prefix wins
+var accessRules []accessRule
+
+type accessRule struct {
+	prefix string
+	public bool
+	users  map[string]string //user -> password
+}
+
+//parseAccessRules parses -protect values: "/internal/=user:pass" requires basic
+//auth for that subtree (repeat for more users), "/internal/pub/=public" opens
+//a subtree again.
+func parseAccessRules(vals []string) error {
+	byPrefix := make(map[string]*accessRule)
+	for _, v := range vals {
+		kv := strings.SplitN(v, "=", 2)
+		if len(kv) != 2 || !strings.HasPrefix(kv[0], "/") {
+			return fmt.Errorf("invalid rule %q, expected /prefix=user:pass or /prefix=public", v)
+		}
+		prefix := strings.ToLower(kv[0])
+		rule, ok := byPrefix[prefix]
+		if !ok {
+			rule = &accessRule{prefix: prefix, users: make(map[string]string)}
+			byPrefix[prefix] = rule
+		}
+		if kv[1] == "public" {
+			rule.public = true
+			continue
+		}
+		up := strings.SplitN(kv[1], ":", 2)
+		if len(up) != 2 || up[0] == "" {
+			return fmt.Errorf("invalid rule %q, expected /prefix=user:pass or /prefix=public", v)
+		}
+		rule.users[up[0]] = up[1]
+	}
+	accessRules = nil
+	for _, rule := range byPrefix {
+		if rule.public && len(rule.users) > 0 {
+			return fmt.Errorf("%s is both public and protected", rule.prefix)
+		}
+		accessRules = append(accessRules, *rule)
+	}
+	sort.Slice(accessRules, func(i, j int) bool { return len(accessRules[i].prefix) > len(accessRules[j].prefix) })
+	return nil
+}
+
+//matches reports whether lower cased key is the rule's path or below it. Whole
+//path segments only, a rule for /internal doesn't cover /internalfoo.
+func (rule *accessRule) matches(key string) bool {
+	dir := strings.TrimSuffix(rule.prefix, "/")
+	return key == dir || strings.HasPrefix(key, dir+"/")
+}
+
+//authorize enforces the access rule for key, writing a 401 and returning false if denied
+func authorize(w http.ResponseWriter, r *http.Request, key string) bool {
+	ok, rule := accessAllowed(r, key)
+	if !ok {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q", rule.prefix))
+		httpError(w, r, "Unauthorized", http.StatusUnauthorized)
+	}
+	return ok
+}
+
+//protected reports whether key is under a rule that requires credentials, so
+//responses for it must not be cached for everyone
+func protected(key string) bool {
+	key = strings.ToLower(key)
+	for i := range accessRules {
+		if rule := &accessRules[i]; rule.matches(key) {
+			return !rule.public
+		}
+	}
+	return false
+}
+
+//accessAllowed reports whether r may access key, and the rule that decided it.
+//Dropbox is case insensitive, so matching is too, otherwise /INTERNAL/ would get around /internal/.
+func accessAllowed(r *http.Request, key string) (bool, *accessRule) {
+	key = strings.ToLower(key)
+	for i := range accessRules {
+		rule := &accessRules[i]
+		if !rule.matches(key) {
+			continue
+		}
+		if rule.public {
+			return true, rule
+		}
+		user, pass, ok := r.BasicAuth()
+		if ok {
+			want, found := rule.users[user]
+			//Compare anyway so unknown users take as long as wrong passwords
+			match := subtle.ConstantTimeCompare([]byte(pass), []byte(want)) == 1
+			if found && match {
+				return true, rule
+			}
+		}
+		return false, rule
+	}
+	return true, nil
+}
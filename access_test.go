@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+//Rules cover whole path segments, /internal is not a prefix of /internalfoo
+func TestAccessRuleBoundary(t *testing.T) {
+	defer func(rules []accessRule) { accessRules = rules }(accessRules)
+	if err := parseAccessRules([]string{"/internal=alice:secret", "/internal/pub/=public", "/docs/=bob:pw"}); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		key       string
+		protected bool
+	}{
+		{"/internal", true},
+		{"/internal/", true},
+		{"/internal/a.txt", true},
+		{"/INTERNAL/a.txt", true},
+		{"/internalfoo", false},
+		{"/internalfoo/a.txt", false},
+		{"/internal/pub/a.txt", false},
+		{"/internal/public.txt", true},
+		{"/docs", true},
+		{"/docs/a.txt", true},
+		{"/docsfoo", false},
+	}
+	for _, tt := range tests {
+		if got := protected(tt.key); got != tt.protected {
+			t.Errorf("protected(%s) = %v, want %v", tt.key, got, tt.protected)
+		}
+		r := httptest.NewRequest("GET", tt.key, nil)
+		if ok, _ := accessAllowed(r, tt.key); ok == tt.protected {
+			t.Errorf("accessAllowed(%s) without credentials = %v, want %v", tt.key, ok, !tt.protected)
+		}
+	}
+}
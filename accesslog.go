@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+var (
+	accessLog = false  //Log every request
+	logFormat = "text" //Access log format, text or json
+	accessEnc = json.NewEncoder(os.Stderr)
+	accessMu  sync.Mutex
+)
+
+type accessKey struct{}
+
+//accessEntry is one access log line
+type accessEntry struct {
+	Time     time.Time `json:"time"`
+	Remote   string    `json:"remote"`
+	Method   string    `json:"method"`
+	Path     string    `json:"path"`
+	Status   int       `json:"status"`
+	Bytes    int64     `json:"bytes"`
+	Cache    string    `json:"cache,omitempty"` //hit, miss or 404 (a cached 404), empty if the cache wasn't involved
+	Duration float64   `json:"duration_ms"`
+	ID       string    `json:"request_id,omitempty"`
+}
+
+//statusRecorder captures the status code and body size written through it
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	if s.status == 0 {
+		s.status = code
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	n, err := s.ResponseWriter.Write(b)
+	s.bytes += int64(n)
+	return n, err
+}
+
+//logAccess wraps h to log every request if -access-log is set
+func logAccess(h http.Handler) http.Handler {
+	if !accessLog {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		e := &accessEntry{Time: start, Remote: clientIP(r), Method: r.Method, Path: r.URL.RequestURI(), ID: requestID(r)}
+		rec := &statusRecorder{ResponseWriter: w}
+		h.ServeHTTP(rec, r.WithContext(context.WithValue(r.Context(), accessKey{}, e)))
+		e.Status = rec.status
+		if e.Status == 0 {
+			e.Status = http.StatusOK
+		}
+		e.Bytes = rec.bytes
+		e.Duration = float64(time.Since(start)) / float64(time.Millisecond)
+		if logFormat == "json" {
+			accessMu.Lock()
+			accessEnc.Encode(e)
+			accessMu.Unlock()
+			return
+		}
+		cache := e.Cache
+		if cache == "" {
+			cache = "-"
+		}
+		log.Printf("%s %s %s %d %d %s %.1fms req=%s", e.Remote, e.Method, e.Path, e.Status, e.Bytes, cache, e.Duration, e.ID)
+	})
+}
+
+//setCacheStatus notes for the access log how the cache answered r
+func setCacheStatus(r *http.Request, status string) {
+	if e, ok := r.Context().Value(accessKey{}).(*accessEntry); ok {
+		e.Cache = status
+	}
+}
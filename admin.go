@@ -0,0 +1,158 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/dropbox/dropbox-sdk-go-unofficial/dropbox/files"
+)
+
+var adminToken = "" //Shared secret for /admin/ endpoints, admin endpoints are disabled when empty
+
+//adminAuthorized checks the X-Admin-Token header (or a bearer token, or the
+//basic auth password for browsers) in constant time
+func adminAuthorized(r *http.Request) bool {
+	tok := r.Header.Get("X-Admin-Token")
+	if _, pass, ok := r.BasicAuth(); tok == "" && ok {
+		tok = pass
+	}
+	if tok == "" {
+		tok = strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	}
+	return subtle.ConstantTimeCompare([]byte(tok), []byte(adminToken)) == 1
+}
+
+func adminHandler(w http.ResponseWriter, r *http.Request) {
+	if !adminAuthorized(r) {
+		httpError(w, r, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	switch r.URL.Path {
+	case "/admin/inspect":
+		adminInspect(w, r)
+	case "/admin/flush":
+		adminFlush(w, r)
+	case "/admin/stats":
+		adminStats(w, r)
+	default:
+		httpError(w, r, "Not found", http.StatusNotFound)
+	}
+}
+
+type inspectResult struct {
+	Path        string `json:"path"`
+	Cached      bool   `json:"cached"`
+	Exists      bool   `json:"exists"`
+	Rev         string `json:"rev,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+	Size        int    `json:"size"`
+	SHA384      string `json:"sha384,omitempty"`
+	//Pointers so they are left out when unknown, omitempty keeps a zero time.Time
+	LastFetch *time.Time `json:"last_fetch,omitempty"`
+	Modified  *time.Time `json:"modified,omitempty"` //ServerModified, sent as Last-Modified
+	//Fresh is whether the entry would be served as is, false if the next request re-fetches it
+	Fresh            *bool     `json:"fresh,omitempty"`
+	LastInvalidation time.Time `json:"last_invalidation"`
+	LiveRev          string    `json:"live_rev,omitempty"`
+	LiveError        string    `json:"live_error,omitempty"`
+	MatchesLive      *bool     `json:"matches_live,omitempty"`
+}
+
+//adminInspect shows what is cached for a single key, ?live=1 also asks Dropbox
+//for the current rev. Bodies are never returned.
+func adminInspect(w http.ResponseWriter, r *http.Request) {
+	key := r.URL.Query().Get("path")
+	if key == "" {
+		httpError(w, r, "path is required", http.StatusBadRequest)
+		return
+	}
+	res := inspectResult{Path: key, LastInvalidation: lastInvalidation()}
+	//Cache keys may carry significant query params, Dropbox only knows the path
+	parts := strings.SplitN(key, "?", 2)
+	ckey := cachePath(parts[0])
+	if len(parts) == 2 {
+		ckey += "?" + parts[1]
+	}
+	if obj, err := dbcache.Get(ckey); err == nil {
+		res.Cached = true
+		res.Exists = obj.exists
+		res.ContentType = obj.contentType
+		res.Size = len(obj.data)
+		lastFetch := obj.lastFetch
+		res.LastFetch = &lastFetch
+		fresh := !obj.stale()
+		res.Fresh = &fresh
+		if obj.hash != nil {
+			res.SHA384 = hex.EncodeToString(obj.hash)
+		}
+		if obj.entry != nil {
+			res.Rev = obj.entry.Rev
+			modified := obj.entry.ServerModified
+			res.Modified = &modified
+		}
+	}
+	if r.URL.Query().Get("live") != "" {
+		var tmp files.IsMetadata
+		err := upstream(r.Context(), func() (err error) {
+			tmp, err = db.GetMetadata(files.NewGetMetadataArg(dropboxPath(parts[0])))
+			return err
+		})
+		if err != nil {
+			res.LiveError = err.Error()
+		} else if entry, ok := tmp.(*files.FileMetadata); ok {
+			res.LiveRev = entry.Rev
+			match := entry.Rev == res.Rev
+			res.MatchesLive = &match
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
+//adminFlush drops the whole cache
+func adminFlush(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		httpError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	n := dbcache.flush()
+	logln(levelInfo, "Flushed", n, "cache entries on admin request")
+	invalidationLog.record("admin", nil)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"flushed": n})
+}
+
+type statsResult struct {
+	Entries      int              `json:"entries"`
+	Bytes        int64            `json:"bytes"`
+	MaxBytes     int64            `json:"max_bytes"`
+	ClassBytes   map[string]int64 `json:"class_bytes"`
+	Hits         int64            `json:"hits"`
+	Misses       int64            `json:"misses"`
+	NegativeHits int64            `json:"negative_hits"`
+	//Seconds since the last successful longpoll, and failed ones since
+	LongpollAge      float64 `json:"longpoll_age_seconds"`
+	LongpollFailures int     `json:"longpoll_failures"`
+}
+
+//adminStats reports cache size and hit/miss counters
+func adminStats(w http.ResponseWriter, r *http.Request) {
+	res := statsResult{
+		MaxBytes:     cacheMaxBytes,
+		ClassBytes:   dbcache.classStats(),
+		Hits:         atomic.LoadInt64(&cacheHits),
+		Misses:       atomic.LoadInt64(&cacheMisses),
+		NegativeHits: atomic.LoadInt64(&negativeHits),
+	}
+	res.Entries, res.Bytes = dbcache.stats()
+	last, failures := health.longpollStatus()
+	res.LongpollAge, res.LongpollFailures = time.Since(last).Seconds(), failures
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+//Times that don't apply are left out, not sent as year 1
+func TestInspectTimes(t *testing.T) {
+	defer func(tok string) { adminToken = tok }(adminToken)
+	adminToken = "secret"
+	fake := newFakeDropbox()
+	file := fake.put("/Public/f.txt", "f")
+	h := testHandler(t, fake)
+	inspect := func(p string) map[string]interface{} {
+		w := request(h, "GET", "/admin/inspect?path="+p, "X-Admin-Token", adminToken)
+		if w.Code != http.StatusOK {
+			t.Fatalf("inspect %s = %d", p, w.Code)
+		}
+		var res map[string]interface{}
+		if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+	res := inspect("/f.txt")
+	for _, field := range []string{"last_fetch", "modified"} {
+		if _, ok := res[field]; ok {
+			t.Errorf("uncached: %s is %v, want it left out", field, res[field])
+		}
+	}
+	request(h, "GET", "/f.txt")
+	res = inspect("/f.txt")
+	if res["modified"] != file.modified.Format(time.RFC3339) {
+		t.Errorf("modified %v, want %s", res["modified"], file.modified)
+	}
+	if _, ok := res["last_fetch"]; !ok {
+		t.Error("cached: no last_fetch")
+	}
+	request(h, "GET", "/missing")
+	res = inspect("/missing")
+	if _, ok := res["modified"]; ok || res["last_fetch"] == nil {
+		t.Errorf("cached 404: modified %v last_fetch %v, want only last_fetch", res["modified"], res["last_fetch"])
+	}
+}
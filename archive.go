@@ -0,0 +1,225 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/dropbox/dropbox-sdk-go-unofficial/dropbox/files"
+)
+
+var (
+	archives           = false //Serve /dir/?download=zip|tar.gz
+	archiveMaxBytes    = int64(1 << 30)
+	archiveConcurrency = 4 //Downloads opened ahead of the one being written
+)
+
+//archiveFile is a file going into an archive
+type archiveFile struct {
+	key   string //URL path
+	name  string //Path inside the archive
+	entry *files.FileMetadata
+}
+
+//dbhandlerArchive streams dir (a URL path ending in /) as a zip or tar.gz.
+//Files the client may not access or that are denied are left out.
+func dbhandlerArchive(w http.ResponseWriter, r *http.Request, dir, format string) {
+	if format != "zip" && format != "tar.gz" {
+		httpError(w, r, "download must be zip or tar.gz", http.StatusBadRequest)
+		return
+	}
+	list, err := archiveList(r, dir)
+	if isNotFound(err) {
+		httpError(w, r, "File not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logRequest(r, err)
+		recentErrors.add(err)
+		upstreamError(w, r, err)
+		return
+	}
+	var total int64
+	for _, f := range list {
+		total += int64(f.entry.Size)
+	}
+	if total > archiveMaxBytes {
+		httpError(w, r, fmt.Sprintf("Folder is too large to archive (%d bytes)", total), http.StatusRequestEntityTooLarge)
+		return
+	}
+	name := path.Base(strings.TrimSuffix(dir, "/"))
+	if name == "/" || name == "." {
+		name = "files"
+	}
+	name += "." + format
+	if format == "zip" {
+		w.Header().Set("Content-Type", "application/zip")
+	} else {
+		w.Header().Set("Content-Type", "application/gzip")
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+	//Generated on the fly, a Range would have to regenerate it
+	w.Header().Set("Accept-Ranges", "none")
+	for _, v := range extraVary {
+		w.Header().Add("Vary", v)
+	}
+	for _, f := range list {
+		if protected(f.key) {
+			//What is in it depends on the credentials
+			setCacheControl(w, true, true)
+			break
+		}
+	}
+	if r.Method == http.MethodHead {
+		//The headers are all we know without downloading everything
+		return
+	}
+
+	var write func(f archiveFile, rd io.Reader) error
+	var closer io.Closer
+	if format == "zip" {
+		zw := zip.NewWriter(w)
+		closer = zw
+		write = func(f archiveFile, rd io.Reader) error {
+			fw, err := zw.CreateHeader(&zip.FileHeader{Name: f.name, Method: zip.Deflate, Modified: f.entry.ServerModified})
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(fw, rd)
+			return err
+		}
+	} else {
+		gz := gzip.NewWriter(w)
+		tw := tar.NewWriter(gz)
+		closer = multiCloser{tw, gz}
+		write = func(f archiveFile, rd io.Reader) error {
+			err := tw.WriteHeader(&tar.Header{Name: f.name, Mode: 0644, Size: int64(f.entry.Size), ModTime: f.entry.ServerModified})
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(tw, rd)
+			return err
+		}
+	}
+	//Open up to archiveConcurrency downloads ahead of the one being written. The
+	//bodies are streams, so this bounds connections, not memory.
+	type opened struct {
+		rd  io.ReadCloser
+		err error
+	}
+	sem := make(chan struct{}, archiveConcurrency)
+	results := make([]chan opened, len(list))
+	for i := range list {
+		results[i] = make(chan opened, 1)
+	}
+	go func() {
+		for i, f := range list {
+			sem <- struct{}{}
+			if r.Context().Err() != nil {
+				results[i] <- opened{err: r.Context().Err()}
+				continue
+			}
+			go func(i int, f archiveFile) {
+				//The slot is only held while opening the download, like dbhandlerStream.
+				//A single 429 would otherwise truncate the whole archive.
+				start := time.Now()
+				var rd io.ReadCloser
+				err := upstream(r.Context(), func() (err error) {
+					_, rd, err = db.Download(files.NewDownloadArg(dropboxPath(f.key)))
+					return err
+				})
+				dropboxStats.observe("download", start, err)
+				results[i] <- opened{rd, err}
+			}(i, f)
+		}
+	}()
+	for i, f := range list {
+		res := <-results[i]
+		if res.err == nil {
+			res.err = write(f, res.rd)
+			res.rd.Close()
+		}
+		<-sem
+		if res.err != nil {
+			//Already streaming, the truncated archive is all the client can tell
+			logRequest(r, "Archive", dir, f.key, res.err)
+			for _, ch := range results[i+1:] {
+				go func(ch chan opened) {
+					if o := <-ch; o.rd != nil {
+						o.rd.Close()
+					}
+					<-sem
+				}(ch)
+			}
+			return
+		}
+	}
+	closer.Close()
+}
+
+//archiveList lists the files under dir recursively, minus ones r may not see
+//and ones over -max-file-size
+func archiveList(r *http.Request, dir string) ([]archiveFile, error) {
+	root := strings.TrimSuffix(dropboxPath(dir), "/")
+	arg := files.NewListFolderArg(root)
+	arg.Recursive = true
+	var res *files.ListFolderResult
+	err := upstream(r.Context(), func() (err error) {
+		res, err = db.ListFolder(arg)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	var list []archiveFile
+	for {
+		for _, e := range res.Entries {
+			entry, ok := e.(*files.FileMetadata)
+			if !ok || len(entry.PathDisplay) <= len(root) {
+				continue
+			}
+			name := strings.TrimPrefix(entry.PathDisplay[len(root):], "/")
+			key := dir + name
+			if deniedBy(key) != nil {
+				continue
+			}
+			if ok, _ := accessAllowed(r, key); !ok {
+				continue
+			}
+			if maxFileSize > 0 && int64(entry.Size) > maxFileSize {
+				//Not proxied on its own either
+				continue
+			}
+			list = append(list, archiveFile{key: key, name: name, entry: entry})
+		}
+		if !res.HasMore {
+			return list, nil
+		}
+		cursor := res.Cursor
+		err = upstream(r.Context(), func() (err error) {
+			res, err = db.ListFolderContinue(files.NewListFolderContinueArg(cursor))
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+//multiCloser closes in order, e.g. the tar writer before the gzip writer under it
+type multiCloser []io.Closer
+
+func (m multiCloser) Close() error {
+	for _, c := range m {
+		if err := c.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+//archiveFake is a folder with a nested file and one over -max-file-size
+func archiveFake(t *testing.T) (*fakeDropbox, http.Handler) {
+	oldArchives, oldMax := archives, maxFileSize
+	t.Cleanup(func() { archives, maxFileSize = oldArchives, oldMax })
+	archives = true
+	maxFileSize = 10
+	fake := newFakeDropbox()
+	fake.put("/Public/site/a.txt", "a")
+	fake.put("/Public/site/sub/b.txt", "bb")
+	fake.put("/Public/site/big.bin", "more than ten bytes")
+	return fake, testHandler(t, fake)
+}
+
+var archiveWant = map[string]string{"a.txt": "a", "sub/b.txt": "bb"}
+
+func TestArchiveZip(t *testing.T) {
+	_, h := archiveFake(t)
+	w := request(h, "GET", "/site/?download=zip")
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/zip" {
+		t.Fatalf("= %d %s, want 200 application/zip", w.Code, w.Header().Get("Content-Type"))
+	}
+	zr, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]string)
+	for _, f := range zr.File {
+		rd, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := ioutil.ReadAll(rd)
+		rd.Close()
+		got[f.Name] = string(b)
+	}
+	if !reflect.DeepEqual(got, archiveWant) {
+		t.Errorf("zip has %v, want %v", got, archiveWant)
+	}
+}
+
+func TestArchiveTarGz(t *testing.T) {
+	_, h := archiveFake(t)
+	w := request(h, "GET", "/site/?download=tar.gz")
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/gzip" {
+		t.Fatalf("= %d %s, want 200 application/gzip", w.Code, w.Header().Get("Content-Type"))
+	}
+	gz, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(gz)
+	got := make(map[string]string)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := ioutil.ReadAll(tr)
+		got[hdr.Name] = string(b)
+	}
+	if !reflect.DeepEqual(got, archiveWant) {
+		t.Errorf("tar.gz has %v, want %v", got, archiveWant)
+	}
+}
+
+//HEAD lists the folder but downloads nothing
+func TestArchiveHead(t *testing.T) {
+	fake, h := archiveFake(t)
+	w := request(h, "HEAD", "/site/?download=zip")
+	if w.Code != http.StatusOK || w.Header().Get("Content-Disposition") != `attachment; filename="site.zip"` {
+		t.Errorf("= %d Content-Disposition %q", w.Code, w.Header().Get("Content-Disposition"))
+	}
+	if n := fake.count("download"); n != 0 {
+		t.Errorf("%d downloads for a HEAD, want none", n)
+	}
+}
+
+func TestArchiveErrors(t *testing.T) {
+	fake, h := archiveFake(t)
+	tests := []struct {
+		target string
+		status int
+	}{
+		{"/missing/?download=zip", http.StatusNotFound},
+		{"/site/?download=rar", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		if w := request(h, "GET", tt.target); w.Code != tt.status {
+			t.Errorf("GET %s = %d, want %d", tt.target, w.Code, tt.status)
+		}
+	}
+	defer func(n int64) { archiveMaxBytes = n }(archiveMaxBytes)
+	archiveMaxBytes = 2
+	if w := request(h, "GET", "/site/?download=zip"); w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("over -archive-max-bytes = %d, want 413", w.Code)
+	}
+	if n := fake.count("download"); n != 0 {
+		t.Errorf("%d downloads for refused archives, want none", n)
+	}
+}
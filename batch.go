@@ -0,0 +1,52 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var batchWorkers = 4 //-batch-workers, items of a bulk operation (like -preload) worked on at once
+
+//batch runs fn for every item, batchWorkers at a time, and returns how many
+//failed. Failures are logged as name, so are progress reports for long
+//batches. The fetches in fn still take upstreamSlots like any other, workers
+//only bound how many bodies the batch itself holds in memory at once.
+func batch(name string, items []string, fn func(item string) error) int {
+	var done, failed int64
+	work := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < batchWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for item := range work {
+				if err := fn(item); err != nil {
+					logln(levelWarn, name, item, err)
+					atomic.AddInt64(&failed, 1)
+				}
+				atomic.AddInt64(&done, 1)
+			}
+		}()
+	}
+	stop := make(chan struct{})
+	go func() {
+		t := time.NewTicker(10 * time.Second)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				logf(levelInfo, "%s: %d/%d done, %d failed", name, atomic.LoadInt64(&done), len(items), atomic.LoadInt64(&failed))
+			case <-stop:
+				return
+			}
+		}
+	}()
+	for _, item := range items {
+		work <- item
+	}
+	close(work)
+	wg.Wait()
+	close(stop)
+	return int(failed)
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+var (
+	bigDir            = ""                      //-big-file-dir, files too big for memory are kept here, empty for none
+	bigMaxSize  int64 = 100 * 1024 * 1024       //Largest file kept in bigDir
+	bigMaxBytes int64 = 10 * 1024 * 1024 * 1024 //Total size of the files in bigDir
+	bigFiles          = &bigCache{entries: make(map[string]*bigEntry), lru: list.New()}
+)
+
+//bigEntry is one file in bigDir, the body of rev of the path key
+type bigEntry struct {
+	key  string
+	rev  string
+	file string
+	size int64
+	elem *list.Element
+}
+
+//bigCache is the disk tier for files bigger than maxCacheSize. Entries are
+//recorded with their rev, every request has the rev from GetMetadata anyway so a
+//changed file is never served from here and its old copy is replaced.
+type bigCache struct {
+	sync.Mutex
+	entries map[string]*bigEntry
+	lru     *list.List //Keys, most recently used at the front
+	bytes   int64
+}
+
+//open returns the stored body of rev of key, nil if there is none
+func (c *bigCache) open(key, rev string) *os.File {
+	c.Lock()
+	defer c.Unlock()
+	e, ok := c.entries[key]
+	if !ok || e.rev != rev {
+		return nil
+	}
+	f, err := os.Open(e.file)
+	if err != nil {
+		logln(levelWarn, "Big file dir:", err)
+		c.remove(e)
+		return nil
+	}
+	c.lru.MoveToFront(e.elem)
+	return f
+}
+
+//diskTee is the file a download is copied into. Write never fails: a full or
+//broken disk must not cut the client's download short, it only marks the copy
+//as failed so commit throws it away.
+type diskTee struct {
+	f   *os.File
+	err error
+}
+
+func (t *diskTee) Write(p []byte) (int, error) {
+	if t.err == nil {
+		_, t.err = t.f.Write(p)
+	}
+	return len(p), nil
+}
+
+//tee returns a writer that stores what the download of rev of key copies
+//through it, and commit to add it once all size bytes are there. On a short or
+//failed copy commit discards the file.
+func (c *bigCache) tee(key, rev string, size int64) (w io.Writer, commit func(n int64)) {
+	f, err := ioutil.TempFile(bigDir, ".tmp-")
+	if err != nil {
+		logln(levelWarn, "Big file dir:", err)
+		return ioutil.Discard, func(int64) {}
+	}
+	t := &diskTee{f: f}
+	return t, func(n int64) {
+		err := f.Close()
+		if t.err != nil {
+			logln(levelWarn, "Big file dir:", t.err)
+		}
+		if err != nil || t.err != nil || n != size {
+			os.Remove(f.Name())
+			return
+		}
+		sum := sha256.Sum256([]byte(key + "@" + rev))
+		name := filepath.Join(bigDir, hex.EncodeToString(sum[:]))
+		if err := os.Rename(f.Name(), name); err != nil {
+			logln(levelWarn, "Big file dir:", err)
+			os.Remove(f.Name())
+			return
+		}
+		c.add(&bigEntry{key: key, rev: rev, file: name, size: size})
+	}
+}
+
+func (c *bigCache) add(e *bigEntry) {
+	c.Lock()
+	defer c.Unlock()
+	if old, ok := c.entries[e.key]; ok {
+		if old.file == e.file {
+			//Two downloads of the same rev, the file was just replaced in place
+			c.lru.MoveToFront(old.elem)
+			return
+		}
+		c.remove(old)
+	}
+	e.elem = c.lru.PushFront(e.key)
+	c.entries[e.key] = e
+	c.bytes += e.size
+	for c.bytes > bigMaxBytes && c.lru.Len() > 1 {
+		c.remove(c.entries[c.lru.Back().Value.(string)])
+	}
+}
+
+//remove drops e and its file. Must be called with the lock held.
+func (c *bigCache) remove(e *bigEntry) {
+	c.lru.Remove(e.elem)
+	delete(c.entries, e.key)
+	c.bytes -= e.size
+	os.Remove(e.file)
+}
+
+//purge drops the entries of paths (and of paths under them), like cache.purge
+func (c *bigCache) purge(paths map[string]bool) {
+	c.Lock()
+	defer c.Unlock()
+	for key, e := range c.entries {
+		for p := strings.ToLower(key); ; p = path.Dir(p) {
+			if paths[p] {
+				c.remove(e)
+				break
+			}
+			if p == "/" || p == "." {
+				break
+			}
+		}
+	}
+}
+
+//bigFileName matches the names tee creates: sha256 hex of key@rev, or a
+//temporary file of an unfinished copy
+var bigFileName = regexp.MustCompile(`^([0-9a-f]{64}|\.tmp-[0-9]+)$`)
+
+//clearBigDir removes what a previous run left in bigDir, its entries are not
+//reloaded. Only our own files: -big-file-dir may well point at a directory
+//with other things in it.
+func clearBigDir() error {
+	if err := os.MkdirAll(bigDir, 0700); err != nil {
+		return err
+	}
+	entries, err := ioutil.ReadDir(bigDir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if e.Mode().IsRegular() && bigFileName.MatchString(e.Name()) {
+			os.Remove(filepath.Join(bigDir, e.Name()))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"container/list"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var noCache bool //-no-cache, every request goes to Dropbox and nothing is kept
+
+var cacheMaxBytes int64 = 256 * 1024 * 1024 //Total body bytes kept in the cache before least recently used objects are evicted
+
+type cache struct {
+	*sync.RWMutex
+	data       map[string]*cacheobj
+	classBytes map[string]int64 //Bytes currently cached per content type class
+	bytes      int64            //Bytes currently cached in total
+	lru        *list.List       //Keys, most recently used at the front
+	lruMu      sync.Mutex       //Guards lru for readers bumping it under the read lock, writers hold the write lock anyway
+	elems      map[string]*list.Element
+	byPath     map[string]map[string]bool //Lower cased path, and every parent of it, to the keys at or below it, for purge
+	purgedAt   map[string]time.Time       //When a path was last purged, a fill that started before must not store its result
+}
+
+//invalidationMemory is how long purgedAt remembers a purge, longer than any
+//fill takes
+const invalidationMemory = 10 * time.Minute
+
+func newcache() *cache {
+	return &cache{
+		RWMutex:    &sync.RWMutex{},
+		data:       make(map[string]*cacheobj),
+		classBytes: make(map[string]int64),
+		lru:        list.New(),
+		elems:      make(map[string]*list.Element),
+		byPath:     make(map[string]map[string]bool),
+		purgedAt:   make(map[string]time.Time),
+	}
+}
+
+//keyPaths returns the lower cased path of key and all its parents, the paths
+//whose purge drops key: a changed file, or a deleted or renamed folder
+func keyPaths(key string) []string {
+	p := strings.ToLower(strings.SplitN(key, "?", 2)[0])
+	paths := []string{p}
+	for p != "/" && p != "." {
+		p = path.Dir(p)
+		paths = append(paths, p)
+	}
+	return paths
+}
+
+func (c *cache) Get(key string) (*cacheobj, error) {
+	if noCache {
+		return nil, errNotCached
+	}
+	//Hits only contend on the recency bump, not on each other's lookups
+	c.RLock()
+	defer c.RUnlock()
+	obj, ok := c.data[key]
+	if ok {
+		c.lruMu.Lock()
+		c.lru.MoveToFront(c.elems[key])
+		c.lruMu.Unlock()
+		return obj, nil
+	}
+	return nil, errNotCached
+}
+
+func (c *cache) Set(key string, obj *cacheobj) error {
+	if noCache {
+		return nil
+	}
+	c.Lock()
+	defer c.Unlock()
+	if _, ok := c.data[key]; !ok && atomic.LoadInt32(&lowMemory) == 1 {
+		//Serve it through without caching rather than risk OOM
+		return nil
+	}
+	for _, p := range keyPaths(key) {
+		if t, ok := c.purgedAt[p]; ok && obj.lastFetch.Before(t) {
+			//Fetched before a change that has been purged already, storing it
+			//would keep the old version until the path changes again
+			return nil
+		}
+	}
+	c.set(key, obj)
+	if cacheDir != "" {
+		if obj.exists {
+			diskWrites.save(key, obj)
+		} else {
+			diskWrites.remove(key)
+		}
+	}
+	return nil
+}
+
+//set stores obj and evicts whatever no longer fits. Must be called with the
+//write lock held.
+func (c *cache) set(key string, obj *cacheobj) {
+	old, ok := c.data[key]
+	if ok {
+		c.classBytes[old.class()] -= old.accounted
+		c.bytes -= old.accounted
+		c.lru.MoveToFront(c.elems[key])
+	} else {
+		c.elems[key] = c.lru.PushFront(key)
+		for _, p := range keyPaths(key) {
+			if c.byPath[p] == nil {
+				c.byPath[p] = make(map[string]bool)
+			}
+			c.byPath[p][key] = true
+		}
+	}
+	c.data[key] = obj
+	obj.key = key
+	obj.accounted = obj.size()
+	class := obj.class()
+	c.classBytes[class] += obj.accounted
+	c.bytes += obj.accounted
+	c.enforceClassBudget(class)
+	c.enforceMaxBytes()
+}
+
+//grow accounts for a compressed copy added to obj after it was cached, which
+//may evict others (or obj itself)
+func (c *cache) grow(obj *cacheobj) {
+	c.Lock()
+	defer c.Unlock()
+	if c.data[obj.key] != obj {
+		//Replaced or evicted meanwhile, nobody counts it anymore
+		return
+	}
+	n := obj.size()
+	class := obj.class()
+	c.classBytes[class] += n - obj.accounted
+	c.bytes += n - obj.accounted
+	obj.accounted = n
+	c.enforceClassBudget(class)
+	c.enforceMaxBytes()
+}
+
+//remove drops key from the cache. Must be called with the write lock held.
+func (c *cache) remove(key string) {
+	obj, ok := c.data[key]
+	if !ok {
+		return
+	}
+	c.classBytes[obj.class()] -= obj.accounted
+	c.bytes -= obj.accounted
+	c.lru.Remove(c.elems[key])
+	delete(c.elems, key)
+	delete(c.data, key)
+	for _, p := range keyPaths(key) {
+		delete(c.byPath[p], key)
+		if len(c.byPath[p]) == 0 {
+			delete(c.byPath, p)
+		}
+	}
+	if cacheDir != "" {
+		diskWrites.remove(key)
+	}
+}
+
+//enforceMaxBytes evicts least recently used objects until we are within
+//cacheMaxBytes. Must be called with the write lock held.
+func (c *cache) enforceMaxBytes() {
+	var evicted []string
+	for c.bytes > cacheMaxBytes && c.lru.Len() > 0 {
+		key := c.lru.Back().Value.(string)
+		c.remove(key)
+		evicted = append(evicted, key)
+	}
+	if len(evicted) > 0 {
+		invalidationLog.record("evict", evicted)
+	}
+}
+
+//enforceClassBudget evicts least recently used objects of the given class until
+//it fits its budget. Must be called with the write lock held.
+func (c *cache) enforceClassBudget(class string) {
+	budget, ok := classBudgets[class]
+	if !ok || c.classBytes[class] <= budget {
+		return
+	}
+	var evicted []string
+	for e := c.lru.Back(); e != nil && c.classBytes[class] > budget; {
+		prev := e.Prev()
+		key := e.Value.(string)
+		if c.data[key].class() == class {
+			c.remove(key)
+			evicted = append(evicted, key)
+		}
+		e = prev
+	}
+	logf(levelInfo, "Evicted %d %s objects, class usage now %d/%d bytes", len(evicted), class, c.classBytes[class], budget)
+	invalidationLog.record("evict", evicted)
+}
+
+//purge drops every entry for the given paths, including query string variants
+//and anything below a path (a deleted or renamed folder). Fills of those paths
+//that are still running are kept from storing what they fetched. Returns the
+//removed keys.
+func (c *cache) purge(paths map[string]bool) []string {
+	now := time.Now()
+	c.Lock()
+	defer c.Unlock()
+	for p, t := range c.purgedAt {
+		if now.Sub(t) > invalidationMemory {
+			delete(c.purgedAt, p)
+		}
+	}
+	var purged []string
+	for p := range paths {
+		//paths are PathLower, keys may not be with -case-sensitive-cache, byPath is lower cased
+		p = strings.ToLower(p)
+		c.purgedAt[p] = now
+		for key := range c.byPath[p] {
+			c.remove(key)
+			purged = append(purged, key)
+		}
+	}
+	return purged
+}
+
+//flush drops every entry, returning how many there were
+func (c *cache) flush() int {
+	c.Lock()
+	defer c.Unlock()
+	n := len(c.data)
+	c.data = make(map[string]*cacheobj)
+	c.classBytes = make(map[string]int64)
+	c.bytes = 0
+	c.lru.Init()
+	c.elems = make(map[string]*list.Element)
+	c.byPath = make(map[string]map[string]bool)
+	if cacheDir != "" {
+		diskWrites.clearAll()
+	}
+	return n
+}
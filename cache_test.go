@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dropbox/dropbox-sdk-go-unofficial/dropbox/files"
+)
+
+func TestSingleRefetchAfterInvalidation(t *testing.T) {
+	for _, changed := range []bool{false, true} {
+		fake := newFakeDropbox()
+		fake.put("/Public/hot.txt", "old")
+		h := testHandler(t, fake)
+		if w := request(h, "GET", "/hot.txt"); w.Code != http.StatusOK {
+			t.Fatalf("GET = %d", w.Code)
+		}
+		if changed {
+			fake.put("/Public/hot.txt", "new")
+		}
+		invalidateAll()
+		//Long enough for every request to arrive while the re-fetch is running
+		fake.delay = 50 * time.Millisecond
+		var wg sync.WaitGroup
+		for i := 0; i < 50; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				w := request(h, "GET", "/hot.txt")
+				if b := w.Body.String(); w.Code != http.StatusOK || (b != "old" && b != "new") {
+					t.Errorf("GET = %d %q", w.Code, b)
+				}
+			}()
+		}
+		wg.Wait()
+		if n := fake.count("get_metadata /public/hot.txt"); n != 2 {
+			t.Errorf("changed=%v: %d get_metadata calls, want 2 (the fill and one re-fetch)", changed, n)
+		}
+		downloads := 1
+		if changed {
+			downloads = 2
+		}
+		if n := fake.count("download"); n != downloads {
+			t.Errorf("changed=%v: %d downloads, want %d", changed, n, downloads)
+		}
+		fake.delay = 0
+		if w := request(h, "GET", "/hot.txt"); changed && w.Body.String() != "new" {
+			t.Errorf("after the re-fetch GET = %q, want new", w.Body.String())
+		}
+	}
+}
+
+//-stale-while-revalidate doesn't serve an old version forever when Dropbox
+//keeps failing
+func TestStaleWhileRevalidateBound(t *testing.T) {
+	defer func(swr bool, window time.Duration) { staleWhileRevalidate, staleWindow = swr, window }(staleWhileRevalidate, staleWindow)
+	staleWhileRevalidate = true
+	staleWindow = 200 * time.Millisecond
+	fake := newFakeDropbox()
+	fake.put("/Public/f.txt", "old")
+	h := testHandler(t, fake)
+	request(h, "GET", "/f.txt")
+	fake.Lock()
+	fake.errs["/public/f.txt"] = fmt.Errorf("connection reset")
+	fake.Unlock()
+	invalidateAll()
+	if w := request(h, "GET", "/f.txt"); w.Code != http.StatusOK || w.Body.String() != "old" {
+		t.Errorf("within -stale-window = %d %q, want the stale 200", w.Code, w.Body.String())
+	}
+	time.Sleep(2 * staleWindow)
+	if w := request(h, "GET", "/f.txt"); w.Code != http.StatusBadGateway {
+		t.Errorf("after -stale-window = %d %q, want the 502 of the failing re-fetch", w.Code, w.Body.String())
+	}
+}
+
+//After a longpoll reports one changed file only that file is checked with
+//Dropbox again, the README's get_metadata claim
+func TestTargetedInvalidation(t *testing.T) {
+	const n = 20
+	fake := newFakeDropbox()
+	for i := 0; i < n; i++ {
+		fake.put(fmt.Sprintf("/Public/site/%d.html", i), fmt.Sprint(i))
+	}
+	h := testHandler(t, fake)
+	getAll := func() {
+		for i := 0; i < n; i++ {
+			if w := request(h, "GET", fmt.Sprintf("/site/%d.html", i)); w.Code != http.StatusOK {
+				t.Fatalf("GET %d = %d", i, w.Code)
+			}
+		}
+	}
+	getAll()
+	changed := fake.put("/Public/site/7.html", "seven")
+	fake.Lock()
+	fake.changes = []files.IsMetadata{changed.metadata()}
+	fake.Unlock()
+	before := fake.count("get_metadata")
+	if _, err := invalidateChanges("/Public", "cursor"); err != nil {
+		t.Fatal(err)
+	}
+	getAll()
+	if calls := fake.count("get_metadata") - before; calls != 1 {
+		t.Errorf("%d get_metadata calls for %d cached files with one changed, want 1", calls, n)
+	}
+	if w := request(h, "GET", "/site/7.html"); w.Body.String() != "seven" {
+		t.Errorf("changed file = %q, want the new version", w.Body.String())
+	}
+}
+
+//A fill that was running when its path changed must not store what it got
+func TestPurgeDuringFill(t *testing.T) {
+	fake := newFakeDropbox()
+	fake.put("/Public/f.txt", "old")
+	fake.hold = make(chan struct{})
+	h := testHandler(t, fake)
+	done := make(chan struct{})
+	go func() {
+		request(h, "GET", "/f.txt")
+		close(done)
+	}()
+	for deadline := time.Now().Add(5 * time.Second); fake.count("get_metadata") == 0; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("fill never started")
+		}
+	}
+	//The fill has its answer for the old version, then the file changes
+	changed := fake.put("/Public/f.txt", "new")
+	fake.Lock()
+	fake.changes = []files.IsMetadata{changed.metadata()}
+	fake.Unlock()
+	if _, err := invalidateChanges("/Public", "cursor"); err != nil {
+		t.Fatal(err)
+	}
+	close(fake.hold)
+	<-done
+	if w := request(h, "GET", "/f.txt"); w.Body.String() != "new" {
+		t.Errorf("GET after the change = %q, want new", w.Body.String())
+	}
+	if n := fake.count("get_metadata /public/f.txt"); n != 2 {
+		t.Errorf("%d get_metadata calls, want 2: the racing fill must not be cached", n)
+	}
+}
+
+//Dropbox paths are case insensitive, so are cache keys, and the longpoll's
+//lower cased paths purge whatever case the entry was filled with
+func TestCaseInsensitiveCache(t *testing.T) {
+	fake := newFakeDropbox()
+	fake.put("/Public/File.txt", "old")
+	h := testHandler(t, fake)
+	for _, target := range []string{"/File.txt", "/file.txt", "/FILE.TXT"} {
+		if w := request(h, "GET", target); w.Code != http.StatusOK || w.Body.String() != "old" {
+			t.Fatalf("GET %s = %d %q", target, w.Code, w.Body.String())
+		}
+	}
+	if n := fake.count("get_metadata"); n != 1 {
+		t.Errorf("%d get_metadata calls, want 1 shared entry", n)
+	}
+	if entries, _ := dbcache.stats(); entries != 1 {
+		t.Errorf("%d cache entries, want 1", entries)
+	}
+	changed := fake.put("/Public/File.txt", "new")
+	fake.Lock()
+	fake.changes = []files.IsMetadata{changed.metadata()}
+	fake.Unlock()
+	if _, err := invalidateChanges("/Public", "cursor"); err != nil {
+		t.Fatal(err)
+	}
+	for _, target := range []string{"/File.txt", "/file.txt"} {
+		if w := request(h, "GET", target); w.Body.String() != "new" {
+			t.Errorf("GET %s after the change = %q, want new", target, w.Body.String())
+		}
+	}
+}
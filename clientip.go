@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+var trustedProxies []*net.IPNet //-trusted-proxy, peers whose X-Forwarded-For / X-Real-IP is believed
+
+//parseTrustedProxies parses -trusted-proxy values, CIDRs or single IPs
+func parseTrustedProxies(vals []string) error {
+	for _, v := range vals {
+		if !strings.Contains(v, "/") {
+			ip := net.ParseIP(v)
+			if ip == nil {
+				return fmt.Errorf("invalid trusted proxy %q", v)
+			}
+			if ip.To4() != nil {
+				v = ip.To4().String() + "/32"
+			} else {
+				v += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(v)
+		if err != nil {
+			return fmt.Errorf("invalid trusted proxy %q: %v", v, err)
+		}
+		trustedProxies = append(trustedProxies, n)
+	}
+	return nil
+}
+
+func trusted(ip net.IP) bool {
+	for _, n := range trustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+//parseHop parses one address as proxies write them: a bare IPv4 or IPv6
+//address, or with a port as in 1.2.3.4:80 or [2001:db8::1]:80. Returns nil if
+//it isn't an address (e.g. "unknown" or an obfuscated identifier).
+func parseHop(s string) net.IP {
+	s = strings.TrimSpace(s)
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		s = host
+	} else if strings.HasPrefix(s, "[") && strings.HasSuffix(s, "]") {
+		s = s[1 : len(s)-1]
+	}
+	if i := strings.IndexByte(s, '%'); i >= 0 {
+		//Zone of a link local address, meaningless off that host
+		s = s[:i]
+	}
+	return net.ParseIP(s)
+}
+
+//clientIP is the address of the client, taken from X-Forwarded-For (or
+//X-Real-IP if there is none) when the connection comes from a trusted proxy.
+//The right most untrusted hop is used, anything left of it could be made up by
+//the client. IPv4 mapped IPv6 addresses are returned as IPv4 so one client
+//always has the same key.
+func clientIP(r *http.Request) string {
+	ip := parseHop(r.RemoteAddr)
+	if ip == nil {
+		//Not from a TCP connection (tests, unix sockets), use it as is
+		return r.RemoteAddr
+	}
+	if !trusted(ip) {
+		return ip.String()
+	}
+	var hops []string
+	for _, v := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(v, ",")...)
+	}
+	if len(hops) == 0 {
+		hops = r.Header.Values("X-Real-IP")
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		hip := parseHop(hops[i])
+		if hip == nil {
+			//Garbage in the chain, don't believe anything left of it
+			break
+		}
+		ip = hip
+		if !trusted(hip) {
+			break
+		}
+	}
+	return ip.String()
+}
+
+//isHTTPS reports whether the client connected with https: to us, or to the
+//trusted proxy in front of us as its X-Forwarded-Proto says. The right most
+//value is the one the proxy next to us set.
+func isHTTPS(r *http.Request) bool {
+	if r.TLS != nil {
+		return true
+	}
+	ip := parseHop(r.RemoteAddr)
+	if ip == nil || !trusted(ip) {
+		return false
+	}
+	protos := strings.Split(strings.Join(r.Header.Values("X-Forwarded-Proto"), ","), ",")
+	return strings.EqualFold(strings.TrimSpace(protos[len(protos)-1]), "https")
+}
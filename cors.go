@@ -0,0 +1,54 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+var corsOrigins []string //Origins allowed to fetch cross origin, "*" for any, see -cors-origin
+
+//corsOrigin returns the Access-Control-Allow-Origin value for r, "" if its
+//origin is not allowed
+func corsOrigin(r *http.Request) string {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return ""
+	}
+	for _, o := range corsOrigins {
+		if o == "*" {
+			return "*"
+		}
+		if strings.EqualFold(o, origin) {
+			return origin
+		}
+	}
+	return ""
+}
+
+//cors sets the CORS response headers, and answers preflight requests. Returns
+//true if r was a preflight and has been handled.
+func cors(w http.ResponseWriter, r *http.Request) bool {
+	if len(corsOrigins) == 0 {
+		return false
+	}
+	allow := corsOrigin(r)
+	if allow != "*" {
+		//The answer depends on the origin
+		w.Header().Add("Vary", "Origin")
+	}
+	if allow == "" {
+		return false
+	}
+	w.Header().Set("Access-Control-Allow-Origin", allow)
+	if r.Method != http.MethodOptions || r.Header.Get("Access-Control-Request-Method") == "" {
+		w.Header().Set("Access-Control-Expose-Headers", "Content-Length, Content-Range, ETag, Last-Modified")
+		return false
+	}
+	w.Header().Set("Access-Control-Allow-Methods", "GET, HEAD, OPTIONS")
+	if h := r.Header.Get("Access-Control-Request-Headers"); h != "" {
+		w.Header().Set("Access-Control-Allow-Headers", h)
+	}
+	w.Header().Set("Access-Control-Max-Age", "86400")
+	w.WriteHeader(http.StatusNoContent)
+	return true
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+)
+
+var (
+	denyPatterns []*regexp.Regexp
+	logDenied    = false
+	//Common targets of vulnerability scanners, dboxserver never serves anything dynamic
+	defaultDenyPatterns = []string{
+		`(?i)^/wp-(admin|login|content|includes)`,
+		`(?i)^/xmlrpc\.php$`,
+		`(?i)\.(php|asp|aspx|jsp|cgi)$`,
+		`(?i)/\.(git|svn|hg)(/|$)`,
+		`(?i)/\.(env|htaccess|htpasswd|DS_Store)$`,
+		`(?i)^/(cgi-bin|phpmyadmin)(/|$)`,
+	}
+)
+
+//setDenyPatterns compiles the deny list, with the defaults first if requested
+func setDenyPatterns(defaults bool, extra []string) error {
+	var pats []string
+	if defaults {
+		pats = append(pats, defaultDenyPatterns...)
+	}
+	pats = append(pats, extra...)
+	for _, p := range pats {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return err
+		}
+		denyPatterns = append(denyPatterns, re)
+	}
+	return nil
+}
+
+//denied 404s requests matching a deny pattern without asking Dropbox, so
+//scanners don't cost API calls or fill the cache with 404s
+func denied(w http.ResponseWriter, r *http.Request, key string) bool {
+	re := deniedBy(key)
+	if re == nil {
+		return false
+	}
+	if logDenied {
+		logf(levelInfo, "Denied %s %s from %s (matched %s)", r.Method, key, clientIP(r), re)
+	}
+	httpError(w, r, "File not found", http.StatusNotFound)
+	return true
+}
+
+//deniedBy returns the deny pattern matching key, or nil
+func deniedBy(key string) *regexp.Regexp {
+	for _, re := range denyPatterns {
+		if re.MatchString(key) {
+			return re
+		}
+	}
+	return nil
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/dropbox/dropbox-sdk-go-unofficial/dropbox/files"
+)
+
+var cacheDir = "" //If set, cached objects are also written here and reloaded on startup
+
+//diskWrites is the only writer to cacheDir, so the file of a key always ends up
+//as the last Set or remove left it
+var diskWrites = &diskWriter{pending: make(map[string]*cacheobj), wake: make(chan struct{}, 1)}
+
+//diskWriter writes the latest state of each queued key, one at a time. Queuing
+//never blocks the cache lock on the disk.
+type diskWriter struct {
+	sync.Mutex
+	pending map[string]*cacheobj //nil removes the file of the key
+	clear   bool                 //Empty cacheDir before the pending writes
+	wake    chan struct{}
+	once    sync.Once
+}
+
+//save queues writing obj as key, replacing whatever is still queued for it
+func (d *diskWriter) save(key string, obj *cacheobj) {
+	d.queue(func() { d.pending[key] = obj })
+}
+
+//remove queues removing the file of key
+func (d *diskWriter) remove(key string) {
+	d.queue(func() { d.pending[key] = nil })
+}
+
+//clearAll queues emptying cacheDir, dropping the writes queued so far
+func (d *diskWriter) clearAll() {
+	d.queue(func() {
+		d.pending = make(map[string]*cacheobj)
+		d.clear = true
+	})
+}
+
+func (d *diskWriter) queue(fn func()) {
+	d.once.Do(func() { go d.run() })
+	d.Lock()
+	fn()
+	d.Unlock()
+	select {
+	case d.wake <- struct{}{}:
+	default:
+		//Already woken, it will see ours too
+	}
+}
+
+func (d *diskWriter) run() {
+	for range d.wake {
+		for d.next() {
+		}
+	}
+}
+
+//next does one queued write, false if there was none
+func (d *diskWriter) next() bool {
+	d.Lock()
+	if d.clear {
+		d.clear = false
+		d.Unlock()
+		clearCacheDir()
+		return true
+	}
+	for key, obj := range d.pending {
+		delete(d.pending, key)
+		d.Unlock()
+		if obj != nil {
+			saveEntry(key, obj)
+		} else {
+			removeEntry(key)
+		}
+		return true
+	}
+	d.Unlock()
+	return false
+}
+
+//diskEntry is what we keep of a cacheobj on disk. FileMetadata itself has
+//fields gob can't handle, so only what we use is kept.
+type diskEntry struct {
+	Key            string
+	Data           []byte
+	ContentType    string
+	Hash           []byte
+	Links          []string
+	Name           string
+	PathLower      string
+	PathDisplay    string
+	Rev            string
+	Size           uint64
+	ServerModified time.Time
+	ContentHash    string
+}
+
+func diskFile(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(cacheDir, hex.EncodeToString(sum[:])+".gob")
+}
+
+//saveEntry writes obj to disk, atomically so a crash never leaves half a file
+func saveEntry(key string, obj *cacheobj) {
+	e := diskEntry{
+		Key:            key,
+		Data:           obj.data,
+		ContentType:    obj.contentType,
+		Hash:           obj.hash,
+		Links:          obj.links,
+		Name:           obj.entry.Name,
+		PathLower:      obj.entry.PathLower,
+		PathDisplay:    obj.entry.PathDisplay,
+		Rev:            obj.entry.Rev,
+		Size:           obj.entry.Size,
+		ServerModified: obj.entry.ServerModified,
+		ContentHash:    obj.entry.ContentHash,
+	}
+	f, err := ioutil.TempFile(cacheDir, ".tmp-")
+	if err != nil {
+		logln(levelWarn, "Cache dir:", err)
+		return
+	}
+	err = gob.NewEncoder(f).Encode(e)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), diskFile(key))
+	}
+	if err != nil {
+		logln(levelWarn, "Cache dir:", err)
+		os.Remove(f.Name())
+	}
+}
+
+func removeEntry(key string) {
+	if err := os.Remove(diskFile(key)); err != nil && !os.IsNotExist(err) {
+		logln(levelWarn, "Cache dir:", err)
+	}
+}
+
+//checkWritable creates dir if needed and writes and removes a probe file in
+//it, so a read only volume fails at startup instead of in every later write
+func checkWritable(dir string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(dir, ".probe-")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write([]byte("probe"))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if rerr := os.Remove(f.Name()); err == nil {
+		err = rerr
+	}
+	return err
+}
+
+//loadCache fills c from cacheDir. Loaded objects count as fetched before the
+//last invalidation, so each is revalidated against its Dropbox rev on first
+//access (without downloading it again if it didn't change).
+func loadCache(c *cache) error {
+	if err := os.MkdirAll(cacheDir, 0700); err != nil {
+		return err
+	}
+	names, err := filepath.Glob(filepath.Join(cacheDir, "*.gob"))
+	if err != nil {
+		return err
+	}
+	c.Lock()
+	defer c.Unlock()
+	for _, name := range names {
+		f, err := os.Open(name)
+		if err != nil {
+			logln(levelWarn, "Cache dir:", err)
+			continue
+		}
+		var e diskEntry
+		err = gob.NewDecoder(f).Decode(&e)
+		f.Close()
+		if err != nil {
+			logln(levelWarn, "Cache dir: dropping", name, err)
+			os.Remove(name)
+			continue
+		}
+		entry := files.NewFileMetadata(e.Name, "", e.ServerModified, e.ServerModified, e.Rev, e.Size)
+		entry.PathLower = e.PathLower
+		entry.PathDisplay = e.PathDisplay
+		entry.ContentHash = e.ContentHash
+		c.set(e.Key, &cacheobj{
+			data:        e.Data,
+			contentType: e.ContentType,
+			hash:        e.Hash,
+			links:       e.Links,
+			exists:      true,
+			entry:       entry,
+		})
+	}
+	logln(levelInfo, "Loaded", len(c.data), "objects from", cacheDir)
+	return nil
+}
+
+func clearCacheDir() {
+	names, _ := filepath.Glob(filepath.Join(cacheDir, "*.gob"))
+	for _, name := range names {
+		os.Remove(name)
+	}
+}
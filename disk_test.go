@@ -0,0 +1,31 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckWritable(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "dboxserver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	dir := filepath.Join(tmp, "new", "cache")
+	if err := checkWritable(dir); err != nil {
+		t.Fatalf("checkWritable(%s) = %v", dir, err)
+	}
+	if names, _ := ioutil.ReadDir(dir); len(names) != 0 {
+		t.Errorf("probe left %d files behind", len(names))
+	}
+	//Not a directory, whoever we run as
+	file := filepath.Join(tmp, "file")
+	if err := ioutil.WriteFile(file, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkWritable(filepath.Join(file, "cache")); err == nil {
+		t.Error("checkWritable under a file succeeded")
+	}
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"io"
+
+	"github.com/dropbox/dropbox-sdk-go-unofficial/dropbox/files"
+)
+
+//dropboxClient is the part of files.Client we use. db is one of these rather
+//than the whole client so a fake can stand in for Dropbox.
+type dropboxClient interface {
+	GetMetadata(arg *files.GetMetadataArg) (files.IsMetadata, error)
+	Download(arg *files.DownloadArg) (*files.FileMetadata, io.ReadCloser, error)
+	GetThumbnail(arg *files.ThumbnailArg) (*files.FileMetadata, io.ReadCloser, error)
+	GetTemporaryLink(arg *files.GetTemporaryLinkArg) (*files.GetTemporaryLinkResult, error)
+	ListFolder(arg *files.ListFolderArg) (*files.ListFolderResult, error)
+	ListFolderContinue(arg *files.ListFolderContinueArg) (*files.ListFolderResult, error)
+	ListFolderGetLatestCursor(arg *files.ListFolderArg) (*files.ListFolderGetLatestCursorResult, error)
+	ListFolderLongpoll(arg *files.ListFolderLongpollArg) (*files.ListFolderLongpollResult, error)
+}
+
+//files.Client must keep satisfying it
+var _ dropboxClient = files.Client(nil)
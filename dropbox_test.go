@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dropbox/dropbox-sdk-go-unofficial/dropbox"
+	"github.com/dropbox/dropbox-sdk-go-unofficial/dropbox/files"
+)
+
+//fakeDropbox is an in memory Dropbox for tests. Paths are Dropbox paths, so
+//under /Public with the default mount.
+type fakeDropbox struct {
+	sync.Mutex
+	files    map[string]*fakeFile        //By lower case path
+	folders  map[string]bool             //Lower case paths of folders
+	metadata map[string]files.IsMetadata //Answers GetMetadata for the path instead, for the odd types
+	errs     map[string]error            //Returned by every call for the path
+	calls    map[string]int              //Calls by method name, and by method and lower case path ("get_metadata /public/x")
+	delay    time.Duration               //Before GetMetadata answers, so concurrent requests overlap
+	hold     chan struct{}               //If set GetMetadata waits until it is closed
+	changes  []files.IsMetadata          //What the next ListFolderContinue reports as changed
+	revs     int
+}
+
+type fakeFile struct {
+	path     string //As put, for PathDisplay
+	data     []byte
+	rev      string
+	modified time.Time
+}
+
+//The fake must keep satisfying dropboxClient like files.Client
+var _ dropboxClient = (*fakeDropbox)(nil)
+
+func newFakeDropbox() *fakeDropbox {
+	return &fakeDropbox{
+		files:    make(map[string]*fakeFile),
+		folders:  map[string]bool{"/public": true},
+		metadata: make(map[string]files.IsMetadata),
+		errs:     make(map[string]error),
+		calls:    make(map[string]int),
+	}
+}
+
+//put creates or changes the file p, with a new rev, and its parent folders
+func (f *fakeDropbox) put(p, data string) *fakeFile {
+	f.Lock()
+	defer f.Unlock()
+	f.revs++
+	file := &fakeFile{
+		path:     p,
+		data:     []byte(data),
+		rev:      fmt.Sprintf("%09x", f.revs),
+		modified: time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC).Add(time.Duration(f.revs) * time.Minute),
+	}
+	f.files[strings.ToLower(p)] = file
+	for dir := path.Dir(p); dir != "/"; dir = path.Dir(dir) {
+		f.folders[strings.ToLower(dir)] = true
+	}
+	return file
+}
+
+func (f *fakeDropbox) remove(p string) {
+	f.Lock()
+	defer f.Unlock()
+	delete(f.files, strings.ToLower(p))
+}
+
+//count is how many times method (or method and path) was called
+func (f *fakeDropbox) count(method string) int {
+	f.Lock()
+	defer f.Unlock()
+	return f.calls[method]
+}
+
+//call counts method and returns the error set for p, if any
+func (f *fakeDropbox) call(method, p string) error {
+	f.Lock()
+	defer f.Unlock()
+	f.calls[method]++
+	f.calls[method+" "+strings.ToLower(p)]++
+	return f.errs[strings.ToLower(p)]
+}
+
+func (file *fakeFile) metadata() *files.FileMetadata {
+	m := files.NewFileMetadata(path.Base(file.path), "id:"+file.rev, file.modified, file.modified, file.rev, uint64(len(file.data)))
+	m.PathLower = strings.ToLower(file.path)
+	m.PathDisplay = file.path
+	sum := sha256.Sum256(file.data)
+	m.ContentHash = hex.EncodeToString(sum[:])
+	return m
+}
+
+func (f *fakeDropbox) lookup(p string) (*fakeFile, bool) {
+	f.Lock()
+	defer f.Unlock()
+	file, ok := f.files[strings.ToLower(p)]
+	return file, ok
+}
+
+//notFoundError is GetMetadata's path/not_found
+func notFoundError() error {
+	return files.GetMetadataAPIError{EndpointError: &files.GetMetadataError{
+		Tagged: dropbox.Tagged{Tag: files.GetMetadataErrorPath},
+		Path:   &files.LookupError{Tagged: dropbox.Tagged{Tag: files.LookupErrorNotFound}},
+	}}
+}
+
+func (f *fakeDropbox) GetMetadata(arg *files.GetMetadataArg) (files.IsMetadata, error) {
+	if err := f.call("get_metadata", arg.Path); err != nil {
+		return nil, err
+	}
+	//Answered now and delivered after the delay, a change meanwhile isn't in it
+	m, err := f.metadataOf(arg.Path)
+	time.Sleep(f.delay)
+	if f.hold != nil {
+		<-f.hold
+	}
+	return m, err
+}
+
+func (f *fakeDropbox) metadataOf(p string) (files.IsMetadata, error) {
+	f.Lock()
+	m, ok := f.metadata[strings.ToLower(p)]
+	folder := f.folders[strings.ToLower(p)]
+	f.Unlock()
+	if ok {
+		return m, nil
+	}
+	if file, ok := f.lookup(p); ok {
+		return file.metadata(), nil
+	}
+	if folder {
+		m := files.NewFolderMetadata(path.Base(p), "id:"+p)
+		m.PathLower = strings.ToLower(p)
+		m.PathDisplay = p
+		return m, nil
+	}
+	return nil, notFoundError()
+}
+
+func (f *fakeDropbox) Download(arg *files.DownloadArg) (*files.FileMetadata, io.ReadCloser, error) {
+	if err := f.call("download", arg.Path); err != nil {
+		return nil, nil, err
+	}
+	file, ok := f.lookup(arg.Path)
+	if !ok {
+		return nil, nil, fmt.Errorf("download %s: not_found", arg.Path)
+	}
+	data := file.data
+	if rh := arg.ExtraHeaders["Range"]; rh != "" {
+		var start, end int
+		if _, err := fmt.Sscanf(rh, "bytes=%d-%d", &start, &end); err != nil {
+			return nil, nil, fmt.Errorf("download %s: bad range %q", arg.Path, rh)
+		}
+		data = data[start : end+1]
+	}
+	return file.metadata(), ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+//GetThumbnail can only tell that there is no such file, it makes no images
+func (f *fakeDropbox) GetThumbnail(arg *files.ThumbnailArg) (*files.FileMetadata, io.ReadCloser, error) {
+	if err := f.call("get_thumbnail", arg.Path); err != nil {
+		return nil, nil, err
+	}
+	if _, ok := f.lookup(arg.Path); !ok {
+		return nil, nil, files.GetThumbnailAPIError{EndpointError: &files.ThumbnailError{
+			Tagged: dropbox.Tagged{Tag: files.ThumbnailErrorPath},
+			Path:   &files.LookupError{Tagged: dropbox.Tagged{Tag: files.LookupErrorNotFound}},
+		}}
+	}
+	return nil, nil, fmt.Errorf("get_thumbnail %s: not supported by the fake", arg.Path)
+}
+
+func (f *fakeDropbox) GetTemporaryLink(arg *files.GetTemporaryLinkArg) (*files.GetTemporaryLinkResult, error) {
+	if err := f.call("get_temporary_link", arg.Path); err != nil {
+		return nil, err
+	}
+	file, ok := f.lookup(arg.Path)
+	if !ok {
+		return nil, fmt.Errorf("get_temporary_link %s: not_found", arg.Path)
+	}
+	return files.NewGetTemporaryLinkResult(file.metadata(), "https://dl.example.com"+file.path), nil
+}
+
+func (f *fakeDropbox) ListFolder(arg *files.ListFolderArg) (*files.ListFolderResult, error) {
+	if err := f.call("list_folder", arg.Path); err != nil {
+		return nil, err
+	}
+	dir := strings.ToLower(arg.Path)
+	f.Lock()
+	defer f.Unlock()
+	if !f.folders[dir] {
+		return nil, files.ListFolderAPIError{EndpointError: &files.ListFolderError{
+			Tagged: dropbox.Tagged{Tag: files.ListFolderErrorPath},
+			Path:   &files.LookupError{Tagged: dropbox.Tagged{Tag: files.LookupErrorNotFound}},
+		}}
+	}
+	var entries []files.IsMetadata
+	under := func(p string) bool {
+		return strings.HasPrefix(p, dir+"/") && (arg.Recursive || !strings.Contains(p[len(dir)+1:], "/"))
+	}
+	for p := range f.folders {
+		if under(p) {
+			m := files.NewFolderMetadata(path.Base(p), "id:"+p)
+			m.PathLower = p
+			m.PathDisplay = p
+			entries = append(entries, m)
+		}
+	}
+	for p, file := range f.files {
+		if under(p) {
+			entries = append(entries, file.metadata())
+		}
+	}
+	return &files.ListFolderResult{Entries: entries, Cursor: "cursor"}, nil
+}
+
+func (f *fakeDropbox) ListFolderContinue(arg *files.ListFolderContinueArg) (*files.ListFolderResult, error) {
+	if err := f.call("list_folder_continue", ""); err != nil {
+		return nil, err
+	}
+	//ListFolder never has more
+	f.Lock()
+	defer f.Unlock()
+	res := &files.ListFolderResult{Entries: f.changes, Cursor: arg.Cursor}
+	f.changes = nil
+	return res, nil
+}
+
+func (f *fakeDropbox) ListFolderGetLatestCursor(arg *files.ListFolderArg) (*files.ListFolderGetLatestCursorResult, error) {
+	if err := f.call("list_folder_get_latest_cursor", arg.Path); err != nil {
+		return nil, err
+	}
+	return files.NewListFolderGetLatestCursorResult("cursor"), nil
+}
+
+func (f *fakeDropbox) ListFolderLongpoll(arg *files.ListFolderLongpollArg) (*files.ListFolderLongpollResult, error) {
+	if err := f.call("list_folder_longpoll", ""); err != nil {
+		return nil, err
+	}
+	return files.NewListFolderLongpollResult(false), nil
+}
+
+//testHandler points the server at fake, with an empty cache and the default
+//mount, and returns newHandler(). Everything is put back when t is done. The
+//state is package global, so no test using it may call t.Parallel.
+func testHandler(t *testing.T, fake *fakeDropbox) http.Handler {
+	oldDB, oldCache, oldMounts, oldFills, oldRefreshes, oldDirs := db, dbcache, mounts, fills, refreshes, dirNames
+	t.Cleanup(func() {
+		db, dbcache, mounts, fills, refreshes, dirNames = oldDB, oldCache, oldMounts, oldFills, oldRefreshes, oldDirs
+	})
+	db = fake
+	dbcache = newcache()
+	mounts = []mount{{prefix: "", folder: "/Public"}}
+	fills = &fetchGroup{calls: make(map[string]*fetchCall)}
+	refreshes = &inflight{keys: make(map[string]bool)}
+	dirNames = &dirCache{dirs: make(map[string]*dirList)}
+	invalidateAll()
+	return newHandler()
+}
+
+//request serves method target on h, header is name, value pairs
+func request(h http.Handler, method, target string, header ...string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, nil)
+	for i := 0; i+1 < len(header); i += 2 {
+		r.Header.Set(header[i], header[i+1])
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestFakeDropboxServes(t *testing.T) {
+	fake := newFakeDropbox()
+	fake.put("/Public/hello.txt", "hello")
+	h := testHandler(t, fake)
+	w := request(h, "GET", "/hello.txt")
+	if w.Code != http.StatusOK || w.Body.String() != "hello" {
+		t.Fatalf("GET /hello.txt = %d %q, want 200 hello", w.Code, w.Body.String())
+	}
+	if w := request(h, "GET", "/hello.txt"); w.Code != http.StatusOK {
+		t.Fatalf("second GET = %d", w.Code)
+	}
+	if n := fake.count("download"); n != 1 {
+		t.Errorf("%d downloads, want 1, the second GET is a cache hit", n)
+	}
+	if w := request(h, "GET", "/missing.txt"); w.Code != http.StatusNotFound {
+		t.Errorf("GET /missing.txt = %d, want 404", w.Code)
+	}
+}
+
+//varies reports whether the response has v in its Vary header
+func varies(w *httptest.ResponseRecorder, v string) bool {
+	for _, line := range w.Header()["Vary"] {
+		for _, name := range strings.Split(line, ",") {
+			if strings.EqualFold(strings.TrimSpace(name), v) {
+				return true
+			}
+		}
+	}
+	return false
+}
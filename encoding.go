@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/andybalholm/brotli"
+	"github.com/dropbox/dropbox-sdk-go-unofficial/dropbox/files"
+)
+
+var minCompressSize = 1400 //Smaller bodies fit in a packet anyway, not worth compressing
+
+var precompressed = false //-precompressed, serve <path>.br and <path>.gz from Dropbox instead of compressing
+
+var gzipLevel = gzip.DefaultCompression //-gzip-level, for gziphandler and our cached gzip copies
+
+//parseGzipLevel parses -gzip-level: 1-9, default, best-speed or best-compression
+func parseGzipLevel(s string) (int, error) {
+	switch s {
+	case "default":
+		return gzip.DefaultCompression, nil
+	case "best-speed":
+		return gzip.BestSpeed, nil
+	case "best-compression":
+		return gzip.BestCompression, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < gzip.BestSpeed || n > gzip.BestCompression {
+		return 0, fmt.Errorf("invalid gzip level %q, want 1-9, default, best-speed or best-compression", s)
+	}
+	return n, nil
+}
+
+//compressibleTypes are compressed by gziphandler for responses we don't compress
+//ourselves. Images, video, archives etc. are compressed already.
+var compressibleTypes = []string{
+	"text/html", "text/plain", "text/css", "text/javascript", "text/xml", "text/csv", "text/markdown",
+	"application/json", "application/javascript", "application/xml", "application/xhtml+xml",
+	"application/rss+xml", "application/atom+xml", "application/manifest+json",
+	"application/wasm", "image/svg+xml", "font/ttf", "font/otf",
+}
+
+//compressible reports whether contentType is worth compressing
+func compressible(contentType string) bool {
+	ct := strings.ToLower(strings.TrimSpace(strings.SplitN(contentType, ";", 2)[0]))
+	if strings.HasPrefix(ct, "text/") {
+		return true
+	}
+	for _, t := range compressibleTypes {
+		if ct == t {
+			return true
+		}
+	}
+	return strings.HasSuffix(ct, "+json") || strings.HasSuffix(ct, "+xml")
+}
+
+//negotiateEncoding picks the best encoding we have for r from enc (in our order
+//of preference), "" for identity
+func negotiateEncoding(r *http.Request, enc ...string) string {
+	accepted := make(map[string]float64)
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		fields := strings.Split(part, ";")
+		name := strings.ToLower(strings.TrimSpace(fields[0]))
+		if name == "" {
+			continue
+		}
+		q := 1.0
+		for _, f := range fields[1:] {
+			f = strings.TrimSpace(f)
+			if strings.HasPrefix(f, "q=") {
+				if v, err := strconv.ParseFloat(f[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		accepted[name] = q
+	}
+	for _, e := range enc {
+		q, ok := accepted[e]
+		if !ok {
+			q, ok = accepted["*"]
+		}
+		if ok && q > 0 {
+			return e
+		}
+	}
+	return ""
+}
+
+//encoded returns obj's body compressed with enc, compressing it on first use.
+//The copy counts against the cache budgets like the body.
+func (o *cacheobj) encoded(enc string) []byte {
+	o.encMu.Lock()
+	if b, ok := o.encodings[enc]; ok {
+		o.encMu.Unlock()
+		return b
+	}
+	var buf bytes.Buffer
+	switch enc {
+	case "br":
+		bw := brotli.NewWriterLevel(&buf, brotli.DefaultCompression)
+		bw.Write(o.data)
+		bw.Close()
+	case "gzip":
+		gw, _ := gzip.NewWriterLevel(&buf, gzipLevel)
+		gw.Write(o.data)
+		gw.Close()
+	default:
+		o.encMu.Unlock()
+		return nil
+	}
+	if o.encodings == nil {
+		o.encodings = make(map[string][]byte)
+	}
+	b := buf.Bytes()
+	o.encodings[enc] = b
+	o.encMu.Unlock()
+	//Not under encMu, the cache lock is taken first elsewhere
+	dbcache.grow(o)
+	return b
+}
+
+//size is the memory obj's bodies take, data and the compressed copies
+func (o *cacheobj) size() int64 {
+	o.encMu.Lock()
+	defer o.encMu.Unlock()
+	n := int64(len(o.data))
+	for _, b := range o.encodings {
+		n += int64(len(b))
+	}
+	return n
+}
+
+//precompressedExt are the sibling extensions looked for with -precompressed, by
+//content coding
+var precompressedExt = map[string]string{"br": ".br", "gzip": ".gz"}
+
+//reuseEncodings gives obj the compressed copies of oldobj, which has the same
+//body
+func reuseEncodings(obj, oldobj *cacheobj) {
+	oldobj.encMu.Lock()
+	defer oldobj.encMu.Unlock()
+	obj.encodings = make(map[string][]byte, len(oldobj.encodings))
+	for enc, b := range oldobj.encodings {
+		obj.encodings[enc] = b
+	}
+	obj.siblings = make(map[string]bool, len(oldobj.siblings))
+	for enc := range oldobj.siblings {
+		obj.siblings[enc] = true
+	}
+	obj.siblingsAt = oldobj.siblingsAt
+}
+
+//loadPrecompressed downloads the .br and .gz siblings of key, if there are any,
+//as the compressed copies of obj so encoded doesn't make its own. Siblings obj
+//already has are not downloaded again.
+func loadPrecompressed(ctx context.Context, r *http.Request, obj *cacheobj, key string) {
+	obj.siblingsAt = time.Now()
+	for enc, ext := range precompressedExt {
+		if ctx.Err() != nil {
+			return
+		}
+		obj.encMu.Lock()
+		have := obj.siblings[enc]
+		obj.encMu.Unlock()
+		if have {
+			continue
+		}
+		start := time.Now()
+		var rd io.ReadCloser
+		err := retryRateLimited(func() (err error) {
+			_, rd, err = db.Download(files.NewDownloadArg(dropboxPath(key + ext)))
+			return err
+		})
+		dropboxStats.observe("download", start, err)
+		if err != nil {
+			if e, ok := err.(files.DownloadAPIError); !ok || e.EndpointError == nil || e.EndpointError.Path == nil || e.EndpointError.Path.Tag != files.LookupErrorNotFound {
+				logRequest(r, "Precompressed", key+ext, err)
+			}
+			continue
+		}
+		stop := closeOnDone(ctx, rd)
+		b, err := ioutil.ReadAll(io.LimitReader(rd, maxCacheSize+1))
+		stop()
+		rd.Close()
+		track(r, "precompressed", start)
+		if err != nil || int64(len(b)) > maxCacheSize {
+			continue
+		}
+		obj.encMu.Lock()
+		if obj.encodings == nil {
+			obj.encodings = make(map[string][]byte)
+		}
+		obj.encodings[enc] = b
+		if obj.siblings == nil {
+			obj.siblings = make(map[string]bool)
+		}
+		obj.siblings[enc] = true
+		obj.encMu.Unlock()
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+var errorFormat = "text" //text or json, see httpError
+
+type errorBody struct {
+	Error       string   `json:"error"`
+	Status      int      `json:"status"`
+	Suggestions []string `json:"suggestions,omitempty"` //Similarly named paths, for 404s with -suggest
+	RequestID   string   `json:"request_id,omitempty"`
+}
+
+//httpError is http.Error, but clients that ask for JSON (or with
+//-error-format=json, clients that don't ask for html) get a JSON body instead of
+//plain text
+func httpError(w http.ResponseWriter, r *http.Request, msg string, code int) {
+	writeError(w, r, errorBody{Error: msg, Status: code})
+}
+
+//writeError writes e as JSON or plain text as negotiated by wantsJSON, with a
+//Content-Length either way
+func writeError(w http.ResponseWriter, r *http.Request, e errorBody) {
+	var body []byte
+	e.RequestID = requestID(r)
+	varyAccept(w)
+	if wantsJSON(r) {
+		body, _ = json.Marshal(e)
+		w.Header().Set("Content-Type", "application/json")
+	} else {
+		msg := e.Error
+		if len(e.Suggestions) > 0 {
+			msg += "\n\nDid you mean:\n" + strings.Join(e.Suggestions, "\n")
+		}
+		body = []byte(msg)
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	}
+	body = append(body, '\n')
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(e.Status)
+	w.Write(body)
+}
+
+//wantsJSON decides the error format by content negotiation: clients asking for
+//application/json get JSON, and with -error-format=json so does everyone not
+//asking for html or plain text
+func wantsJSON(r *http.Request) bool {
+	accept := r.Header.Get("Accept")
+	if strings.Contains(accept, "application/json") {
+		return true
+	}
+	return errorFormat == "json" && !strings.Contains(accept, "text/html") && !strings.Contains(accept, "text/plain")
+}
+
+//varyAccept adds Vary: Accept to a response chosen by the Accept header, once
+func varyAccept(w http.ResponseWriter) {
+	for _, v := range w.Header()["Vary"] {
+		if strings.EqualFold(v, "Accept") {
+			return
+		}
+	}
+	w.Header().Add("Vary", "Accept")
+}
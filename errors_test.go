@@ -0,0 +1,38 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestErrorFormat(t *testing.T) {
+	defer func(f string) { errorFormat = f }(errorFormat)
+	tests := []struct {
+		format, accept string
+		json           bool
+	}{
+		{"text", "", false},
+		{"text", "text/html", false},
+		{"text", "application/json", true},
+		{"text", "text/html, application/json;q=0.9", true},
+		{"json", "", true},
+		{"json", "*/*", true},
+		{"json", "text/html", false},
+		{"json", "text/plain", false},
+	}
+	fake := newFakeDropbox()
+	h := testHandler(t, fake)
+	for _, tt := range tests {
+		errorFormat = tt.format
+		w := request(h, "GET", "/missing.bin", "Accept", tt.accept)
+		var e errorBody
+		isJSON := json.Unmarshal(w.Body.Bytes(), &e) == nil
+		if w.Code != http.StatusNotFound || isJSON != tt.json || (isJSON && e.Status != http.StatusNotFound) {
+			t.Errorf("-error-format %s Accept %q: %d %q, want JSON %v", tt.format, tt.accept, w.Code, w.Body.String(), tt.json)
+		}
+		if !varies(w, "Accept") {
+			t.Errorf("-error-format %s Accept %q: Vary %q, want Accept", tt.format, tt.accept, w.Header()["Vary"])
+		}
+	}
+}
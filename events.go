@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+var invalidationLog = &eventLog{} //Opt in record of every invalidation, see -invalidation-log
+
+//eventLog writes events from a goroutine of its own: record is called with the
+//cache lock held, which must not wait for the disk
+type eventLog struct {
+	events  chan invalidationEvent //nil until open
+	dropped int64                  //Events the full channel had no room for, accessed atomically
+}
+
+type invalidationEvent struct {
+	Time    time.Time `json:"time"`
+	Trigger string    `json:"trigger"`        //What caused it, e.g. longpoll, evict or ttl
+	All     bool      `json:"all,omitempty"`  //Whole cache was invalidated
+	Keys    []string  `json:"keys,omitempty"` //Otherwise the purged keys
+}
+
+//open starts appending events as JSON lines to name, "-" means stderr. Called
+//once by main before anything is served.
+func (l *eventLog) open(name string) error {
+	f := os.Stderr
+	if name != "-" {
+		var err error
+		f, err = os.OpenFile(name, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			return err
+		}
+	}
+	l.events = make(chan invalidationEvent, 1000)
+	go l.write(json.NewEncoder(f))
+	return nil
+}
+
+func (l *eventLog) write(enc *json.Encoder) {
+	for ev := range l.events {
+		if n := atomic.SwapInt64(&l.dropped, 0); n > 0 {
+			logf(levelWarn, "Invalidation log: %d events dropped, writing can't keep up", n)
+		}
+		if err := enc.Encode(ev); err != nil {
+			logln(levelWarn, "Invalidation log:", err)
+		}
+	}
+}
+
+//record logs an invalidation. keys nil means everything was invalidated. It
+//never blocks, if the writer is that far behind the event is dropped.
+func (l *eventLog) record(trigger string, keys []string) {
+	if l.events == nil {
+		return
+	}
+	select {
+	case l.events <- invalidationEvent{Time: time.Now(), Trigger: trigger, All: keys == nil, Keys: keys}:
+	default:
+		atomic.AddInt64(&l.dropped, 1)
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+//Refetches after -poll-ttl and -negative-ttl are logged with their trigger
+func TestTTLInvalidationEvents(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "dboxserver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	oldLog, oldMode, oldTTL, oldNegative := invalidationLog, pollMode, pollTTL, negativeTTL
+	defer func() { invalidationLog, pollMode, pollTTL, negativeTTL = oldLog, oldMode, oldTTL, oldNegative }()
+	name := filepath.Join(tmp, "events.log")
+	invalidationLog = &eventLog{}
+	if err := invalidationLog.open(name); err != nil {
+		t.Fatal(err)
+	}
+	fake := newFakeDropbox()
+	fake.put("/Public/f.txt", "f")
+	h := testHandler(t, fake)
+	pollMode = "ttl"
+	pollTTL = 20 * time.Millisecond
+	negativeTTL = 0
+	request(h, "GET", "/f.txt")
+	time.Sleep(2 * pollTTL)
+	request(h, "GET", "/f.txt")
+	pollMode = "longpoll"
+	negativeTTL = 20 * time.Millisecond
+	request(h, "GET", "/missing")
+	time.Sleep(2 * negativeTTL)
+	request(h, "GET", "/missing")
+
+	want := []string{"ttl /f.txt", "negative-ttl /missing"}
+	var got []string
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		data, _ := ioutil.ReadFile(name)
+		got = nil
+		for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+			var ev invalidationEvent
+			if json.Unmarshal([]byte(line), &ev) == nil {
+				got = append(got, ev.Trigger+" "+strings.Join(ev.Keys, ","))
+			}
+		}
+		if contains(got, want) {
+			return
+		}
+	}
+	t.Errorf("events %q, want %q among them", got, want)
+}
+
+//contains reports whether every one of want is in got
+func contains(got, want []string) bool {
+	seen := make(map[string]bool)
+	for _, g := range got {
+		seen[g] = true
+	}
+	for _, w := range want {
+		if !seen[w] {
+			return false
+		}
+	}
+	return true
+}
+
+//record is called with the cache lock held, it must never wait for the writer
+func TestEventLogNeverBlocks(t *testing.T) {
+	l := &eventLog{events: make(chan invalidationEvent, 1)}
+	done := make(chan struct{})
+	go func() {
+		l.record("evict", []string{"/a"})
+		l.record("evict", []string{"/b"})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("record blocked on a full channel")
+	}
+	if l.dropped != 1 {
+		t.Errorf("%d dropped, want 1", l.dropped)
+	}
+}
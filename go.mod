@@ -3,8 +3,9 @@ module github.com/sajal/dboxserver
 go 1.14
 
 require (
-	github.com/NYTimes/gziphandler v1.1.1 // indirect
-	github.com/dropbox/dropbox-sdk-go-unofficial v5.6.0+incompatible // indirect
-	golang.org/x/crypto v0.0.0-20201002170205-7f63de1d35b0 // indirect
-	golang.org/x/oauth2 v0.0.0-20200902213428-5d25da1a8d43 // indirect
+	github.com/NYTimes/gziphandler v1.1.1
+	github.com/andybalholm/brotli v1.0.4
+	github.com/dropbox/dropbox-sdk-go-unofficial v5.6.0+incompatible
+	golang.org/x/crypto v0.0.0-20201002170205-7f63de1d35b0
+	golang.org/x/oauth2 v0.0.0-20200902213428-5d25da1a8d43
 )
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dropbox/dropbox-sdk-go-unofficial/dropbox/auth"
+	"github.com/dropbox/dropbox-sdk-go-unofficial/dropbox/files"
+)
+
+var (
+	health             = &healthState{started: time.Now()}
+	selfcheckPath      = ""               //A file that changes regularly, used to verify invalidation works
+	selfcheckInterval  = time.Minute      //How often to compare it against Dropbox
+	selfcheckThreshold = 10 * time.Minute //How long a stale rev may be served before we are unhealthy
+	longpollAlertAfter = 5                //Consecutive longpoll failures before we are unhealthy and alert
+	longpollAlertCmd   = ""               //Optional shell command run when that happens
+	longpollAlertLimit = time.Minute      //How long the alert command may run before it is killed
+	longpollStaleAfter time.Duration      //Time without a successful longpoll before we are unhealthy, 0 for 3x -longpoll-timeout
+)
+
+type healthState struct {
+	sync.Mutex
+	selfcheck   string                     //Non empty when the invalidation self check failed
+	started     time.Time                  //Nothing is cached before, so nothing can be stale yet
+	longpolls   map[string]*longpollHealth //By folder, each mount has its own longpoll
+	authFailure string                     //Last auth error from Dropbox, cleared by the next successful call
+}
+
+type longpollHealth struct {
+	failures int       //Consecutive longpoll failures
+	last     time.Time //Last successful longpoll cycle
+	stale    bool      //We logged that last is too old
+}
+
+//longpollOf returns the longpoll health of folder, h must be locked
+func (h *healthState) longpollOf(folder string) *longpollHealth {
+	if h.longpolls == nil {
+		h.longpolls = make(map[string]*longpollHealth)
+	}
+	lp, ok := h.longpolls[folder]
+	if !ok {
+		lp = &longpollHealth{last: h.started}
+		h.longpolls[folder] = lp
+	}
+	return lp
+}
+
+//watchLongpoll registers folder, so it counts as stale even if its longpoll
+//never gets as far as a result
+func (h *healthState) watchLongpoll(folder string) {
+	h.Lock()
+	h.longpollOf(folder)
+	h.Unlock()
+}
+
+//folders returns the longpolled folders sorted, h must be locked
+func (h *healthState) folders() []string {
+	var folders []string
+	for f := range h.longpolls {
+		folders = append(folders, f)
+	}
+	sort.Strings(folders)
+	return folders
+}
+
+//problems returns the reasons we are unhealthy, if any
+func (h *healthState) problems() []string {
+	h.Lock()
+	defer h.Unlock()
+	var p []string
+	if atomic.LoadInt32(&ready) == 0 {
+		p = append(p, "dropbox: not connected yet")
+	}
+	if h.selfcheck != "" {
+		p = append(p, h.selfcheck)
+	}
+	if h.authFailure != "" {
+		p = append(p, "auth: "+h.authFailure)
+	}
+	//Any failing folder is a problem, however well the others poll
+	for _, folder := range h.folders() {
+		lp := h.longpolls[folder]
+		if longpollAlertAfter > 0 && lp.failures >= longpollAlertAfter {
+			p = append(p, fmt.Sprintf("longpoll %s: %d consecutive failures", folder, lp.failures))
+		}
+		if since := time.Since(lp.last); pollMode == "longpoll" && since > h.staleAfter() {
+			msg := fmt.Sprintf("longpoll %s: no successful poll for %s, cached files may be stale", folder, since.Round(time.Second))
+			if !lp.stale {
+				logln(levelError, "ERROR:", msg)
+				lp.stale = true
+			}
+			p = append(p, msg)
+		}
+	}
+	return p
+}
+
+//staleAfter is longpollStaleAfter or its default
+func (h *healthState) staleAfter() time.Duration {
+	if longpollStaleAfter > 0 {
+		return longpollStaleAfter
+	}
+	return 3 * time.Duration(longpollTimeout) * time.Second
+}
+
+//longpollStatus returns the worst of the folders: the oldest last successful
+//longpoll and the most failures since
+func (h *healthState) longpollStatus() (time.Time, int) {
+	h.Lock()
+	defer h.Unlock()
+	last, failures := h.started, 0
+	for i, folder := range h.folders() {
+		lp := h.longpolls[folder]
+		if i == 0 || lp.last.Before(last) {
+			last = lp.last
+		}
+		if lp.failures > failures {
+			failures = lp.failures
+		}
+	}
+	return last, failures
+}
+
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	if p := health.problems(); len(p) > 0 {
+		httpError(w, r, strings.Join(p, "\n"), http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("ok\n"))
+}
+
+//selfcheckloop passively verifies that longpoll invalidation works. If the rev
+//we would serve for selfcheckPath differs from the live one in Dropbox for
+//longer than selfcheckThreshold, changes are not being detected.
+func selfcheckloop() {
+	var mismatchSince time.Time
+	for {
+		time.Sleep(selfcheckInterval)
+		obj, err := dbcache.Get(cachePath(selfcheckPath))
+		if err != nil || !obj.exists || obj.lastFetch.Before(lastInvalidation()) {
+			//Nothing would be served from cache, so nothing can be stale
+			mismatchSince = time.Time{}
+			health.setSelfcheck("")
+			continue
+		}
+		var tmp files.IsMetadata
+		err = upstream(context.Background(), func() (err error) {
+			tmp, err = db.GetMetadata(files.NewGetMetadataArg(dropboxPath(selfcheckPath)))
+			return err
+		})
+		if err != nil {
+			logln(levelError, "Selfcheck:", err)
+			continue
+		}
+		entry, ok := tmp.(*files.FileMetadata)
+		if !ok || entry.Rev == obj.entry.Rev {
+			mismatchSince = time.Time{}
+			health.setSelfcheck("")
+			continue
+		}
+		if mismatchSince.IsZero() {
+			mismatchSince = time.Now()
+		}
+		if stale := time.Since(mismatchSince); stale > selfcheckThreshold {
+			msg := fmt.Sprintf("invalidation: %s cached rev %s, live rev %s for %s (last change detected %s ago)",
+				selfcheckPath, obj.entry.Rev, entry.Rev, stale.Round(time.Second), time.Since(lastInvalidation()).Round(time.Second))
+			logln(levelError, msg)
+			health.setSelfcheck(msg)
+		}
+	}
+}
+
+func (h *healthState) setSelfcheck(msg string) {
+	h.Lock()
+	h.selfcheck = msg
+	h.Unlock()
+}
+
+//longpollResult records the outcome of a longpoll cycle of folder, escalating
+//once its failures reach longpollAlertAfter.
+func (h *healthState) longpollResult(folder string, err error) {
+	h.Lock()
+	lp := h.longpollOf(folder)
+	if err == nil {
+		lp.failures = 0
+		lp.last = time.Now()
+		lp.stale = false
+		//We got a cursor with our credentials, so they are good
+		h.authFailure = ""
+		h.Unlock()
+		return
+	}
+	if _, ok := err.(auth.AuthAPIError); ok {
+		h.authFailure = err.Error()
+	}
+	lp.failures++
+	n := lp.failures
+	h.Unlock()
+	if longpollAlertAfter <= 0 || n != longpollAlertAfter {
+		return
+	}
+	logf(levelError, "ERROR: longpoll of %s failed %d times in a row, cache invalidation is broken: %v", folder, n, err)
+	if longpollAlertCmd != "" {
+		//In its own goroutine, a hanging alert must not stop the longpoll
+		go runAlert(longpollAlertCmd, longpollAlertLimit, "LONGPOLL_FOLDER="+folder, fmt.Sprintf("LONGPOLL_FAILURES=%d", n), "LONGPOLL_ERROR="+err.Error())
+	}
+}
+
+//runAlert runs command with env added, killing it after limit
+func runAlert(command string, limit time.Duration, env ...string) {
+	ctx, cancel := context.WithTimeout(context.Background(), limit)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "sh", "-c", command)
+	cmd.Env = append(os.Environ(), env...)
+	out, err := cmd.CombinedOutput()
+	if ctx.Err() == context.DeadlineExceeded {
+		logf(levelError, "Alert command killed after %s: %s", limit, out)
+		return
+	}
+	if err != nil {
+		logf(levelError, "Alert command failed: %v: %s", err, out)
+	}
+}
+
+//authFailing reports whether the last Dropbox call was rejected for our credentials
+func (h *healthState) authFailing() bool {
+	h.Lock()
+	defer h.Unlock()
+	return h.authFailure != ""
+}
+
+func (h *healthState) setAuthFailure(err error) {
+	h.Lock()
+	defer h.Unlock()
+	if err == nil {
+		h.authFailure = ""
+		return
+	}
+	h.authFailure = err.Error()
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+//A hanging alert command must neither block the longpoll nor run forever
+func TestAlertCommandTimeout(t *testing.T) {
+	oldAfter, oldCmd, oldLimit, oldHealth := longpollAlertAfter, longpollAlertCmd, longpollAlertLimit, health
+	defer func() {
+		longpollAlertAfter, longpollAlertCmd, longpollAlertLimit, health = oldAfter, oldCmd, oldLimit, oldHealth
+	}()
+	longpollAlertAfter = 1
+	longpollAlertCmd = "exec sleep 10"
+	longpollAlertLimit = 100 * time.Millisecond
+	health = &healthState{started: time.Now()}
+	start := time.Now()
+	health.longpollResult("/Public", errors.New("connection refused"))
+	if d := time.Since(start); d > 50*time.Millisecond {
+		t.Errorf("longpollResult took %s, the alert must run in the background", d)
+	}
+	start = time.Now()
+	runAlert(longpollAlertCmd, longpollAlertLimit)
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("runAlert took %s, want it killed after %s", d, longpollAlertLimit)
+	}
+}
+
+//A folder polling fine must not hide another that keeps failing
+func TestLongpollHealthPerFolder(t *testing.T) {
+	oldAfter, oldStale, oldMode, oldHealth := longpollAlertAfter, longpollStaleAfter, pollMode, health
+	defer func() {
+		longpollAlertAfter, longpollStaleAfter, pollMode, health = oldAfter, oldStale, oldMode, oldHealth
+	}()
+	longpollAlertAfter = 3
+	longpollStaleAfter = time.Hour
+	pollMode = "longpoll"
+	health = &healthState{started: time.Now()}
+	health.watchLongpoll("/Broken")
+	for i := 0; i < longpollAlertAfter; i++ {
+		health.longpollResult("/Public", nil)
+		health.longpollResult("/Broken", errors.New("connection refused"))
+	}
+	p := strings.Join(health.problems(), "\n")
+	if !strings.Contains(p, "longpoll /Broken: 3 consecutive failures") || strings.Contains(p, "/Public") {
+		t.Errorf("problems %q, want only /Broken failing", p)
+	}
+	if _, failures := health.longpollStatus(); failures != 3 {
+		t.Errorf("longpollStatus failures %d, want 3", failures)
+	}
+
+	//Stale is per folder too
+	health = &healthState{started: time.Now().Add(-2 * time.Hour)}
+	health.watchLongpoll("/Broken")
+	health.longpollResult("/Public", nil)
+	p = strings.Join(health.problems(), "\n")
+	if !strings.Contains(p, "longpoll /Broken: no successful poll") || strings.Contains(p, "/Public") {
+		t.Errorf("problems %q, want only /Broken stale", p)
+	}
+	if last, _ := health.longpollStatus(); time.Since(last) < time.Hour {
+		t.Errorf("longpollStatus last %s, want the stale folder's", last)
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"html"
+	"regexp"
+	"strings"
+)
+
+var (
+	rewriteBase = "" //If set, inject or rewrite <base href> in html responses to this prefix
+	baseRe      = regexp.MustCompile(`(?is)<base\b[^>]*>`)
+	headRe      = regexp.MustCompile(`(?is)<head\b[^>]*>`)
+)
+
+//rewriteBaseHref makes relative links in html pages resolve under rewriteBase by
+//replacing an existing <base> tag, or adding one right after <head>.
+func rewriteBaseHref(data []byte, contentType string) []byte {
+	if rewriteBase == "" || !strings.HasPrefix(contentType, "text/html") {
+		return data
+	}
+	tag := []byte(`<base href="` + html.EscapeString(rewriteBase) + `">`)
+	if loc := baseRe.FindIndex(data); loc != nil {
+		return concat(data[:loc[0]], tag, data[loc[1]:])
+	}
+	if loc := headRe.FindIndex(data); loc != nil {
+		return concat(data[:loc[1]], tag, data[loc[1]:])
+	}
+	//No head, browsers still honor a leading base tag
+	return concat(tag, data)
+}
+
+//concat joins byte slices into a new slice, never aliasing the inputs
+func concat(parts ...[]byte) []byte {
+	n := 0
+	for _, p := range parts {
+		n += len(p)
+	}
+	out := make([]byte, 0, n)
+	for _, p := range parts {
+		out = append(out, p...)
+	}
+	return out
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"net/http"
+	"sync/atomic"
+)
+
+var (
+	inflightSlots chan struct{} //Semaphore bounding requests being handled, see -max-inflight
+	shedRequests  int64         //Requests answered 503 because of -max-inflight, accessed atomically
+)
+
+//limitInflight answers requests beyond -max-inflight with an immediate 503
+//instead of queueing them, so a flood can't run us out of memory or file
+//descriptors. Health checks and metrics are exempt, an overloaded instance
+//must still be observable.
+func limitInflight(h http.Handler) http.Handler {
+	if inflightSlots == nil {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/healthz", "/readyz", "/metrics":
+			h.ServeHTTP(w, r)
+			return
+		}
+		select {
+		case inflightSlots <- struct{}{}:
+			defer func() { <-inflightSlots }()
+			h.ServeHTTP(w, r)
+		default:
+			atomic.AddInt64(&shedRequests, 1)
+			w.Header().Set("Retry-After", "1")
+			httpError(w, r, "Server busy, try again later", http.StatusServiceUnavailable)
+		}
+	})
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLimitInflight(t *testing.T) {
+	old := inflightSlots
+	inflightSlots = make(chan struct{}, 1)
+	defer func() { inflightSlots = old }()
+	//Otherwise /metrics would be a Dropbox lookup, stuck behind hold
+	metricsPage = true
+	defer func() { metricsPage = false }()
+	fake := newFakeDropbox()
+	fake.put("/Public/slow.txt", "slow")
+	fake.hold = make(chan struct{})
+	h := testHandler(t, fake)
+	done := make(chan int)
+	go func() { done <- request(h, "GET", "/slow.txt").Code }()
+	//Wait for it to take the only slot
+	for deadline := time.Now().Add(5 * time.Second); len(inflightSlots) == 0; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("first request never started")
+		}
+	}
+	shed := atomic.LoadInt64(&shedRequests)
+	start := time.Now()
+	w := request(h, "GET", "/other.txt")
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") == "" {
+		t.Errorf("request beyond the limit = %d, Retry-After %q, want 503 with Retry-After", w.Code, w.Header().Get("Retry-After"))
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("shedding took %v, it must not wait for a slot", d)
+	}
+	for _, p := range []string{"/healthz", "/readyz", "/metrics"} {
+		if w := request(h, "GET", p); w.Header().Get("Retry-After") != "" {
+			t.Errorf("%s was shed", p)
+		}
+	}
+	if n := atomic.LoadInt64(&shedRequests) - shed; n != 1 {
+		t.Errorf("%d requests shed, want 1", n)
+	}
+	close(fake.hold)
+	if code := <-done; code != http.StatusOK {
+		t.Errorf("first request = %d, want 200", code)
+	}
+	if w := request(h, "GET", "/slow.txt"); w.Code != http.StatusOK {
+		t.Errorf("after the slot is free = %d, want 200", w.Code)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/dropbox/dropbox-sdk-go-unofficial/dropbox/files"
+)
+
+var listing = false //JSON listing for directories without an index file
+
+type listingEntry struct {
+	Name     string     `json:"name"`
+	Size     uint64     `json:"size"`
+	Folder   bool       `json:"folder"`
+	Modified *time.Time `json:"modified,omitempty"` //Server modified time, files only
+}
+
+//dirListing returns the JSON listing of dir (a url path ending in /), or nil if
+//it can't be listed (most likely it doesn't exist either)
+func dirListing(dir string) []byte {
+	p := strings.TrimSuffix(dropboxPath(dir), "/")
+	var res *files.ListFolderResult
+	err := upstream(context.Background(), func() (err error) {
+		res, err = db.ListFolder(files.NewListFolderArg(p))
+		return err
+	})
+	if err != nil {
+		logln(levelError, "Listing", dir, err)
+		return nil
+	}
+	entries := []listingEntry{}
+	for {
+		for _, e := range res.Entries {
+			switch m := e.(type) {
+			case *files.FileMetadata:
+				if deniedBy(dir+m.Name) != nil {
+					continue
+				}
+				mtime := m.ServerModified
+				entries = append(entries, listingEntry{Name: m.Name, Size: m.Size, Modified: &mtime})
+			case *files.FolderMetadata:
+				if deniedBy(dir+m.Name+"/") != nil {
+					continue
+				}
+				entries = append(entries, listingEntry{Name: m.Name, Folder: true})
+			}
+		}
+		if !res.HasMore {
+			break
+		}
+		cursor := res.Cursor
+		err = upstream(context.Background(), func() (err error) {
+			res, err = db.ListFolderContinue(files.NewListFolderContinueArg(cursor))
+			return err
+		})
+		if err != nil {
+			logln(levelError, "Listing", dir, err)
+			return nil
+		}
+	}
+	data, err := json.Marshal(entries)
+	if err != nil {
+		logln(levelError, "Listing", dir, err)
+		return nil
+	}
+	return data
+}
+
+//serveListing writes the listing cached in the 404 object of a directory's index file
+func serveListing(w http.ResponseWriter, r *http.Request, obj *cacheobj) {
+	w.Header().Set("Content-Type", "application/json")
+	//Range is ignored, the listing is always sent whole
+	w.Header().Set("Accept-Ranges", "none")
+	setCacheControl(w, true, protected(r.URL.Path))
+	w.Write(obj.data)
+}
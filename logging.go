@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+//logLevel is how much we log, each level includes the ones before it
+type logLevel int
+
+const (
+	levelError logLevel = iota //Things that need an operator
+	levelWarn                  //Failures we recover from
+	levelInfo                  //Normal operation: invalidations, startup, evictions
+	levelDebug                 //Also the raw Dropbox API traffic from the SDK
+)
+
+var logLevelSet = levelInfo //-log-level
+
+//parseLogLevel parses -log-level: error, warn, info or debug
+func parseLogLevel(s string) (logLevel, error) {
+	switch strings.ToLower(s) {
+	case "error":
+		return levelError, nil
+	case "warn", "warning":
+		return levelWarn, nil
+	case "info":
+		return levelInfo, nil
+	case "debug":
+		return levelDebug, nil
+	}
+	return 0, fmt.Errorf("invalid log level %q, use error, warn, info or debug", s)
+}
+
+//logln is log.Println if -log-level includes l
+func logln(l logLevel, v ...interface{}) {
+	if l <= logLevelSet {
+		log.Println(v...)
+	}
+}
+
+//logf is log.Printf if -log-level includes l
+func logf(l logLevel, format string, v ...interface{}) {
+	if l <= logLevelSet {
+		log.Printf(format, v...)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bufio"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	minFreeMemory int64 //Stop adding cache entries when less than this many bytes are available, 0 disables
+	lowMemory     int32 //Set to 1 while we are below minFreeMemory, accessed atomically
+)
+
+//memoryloop periodically samples available memory and toggles lowMemory
+func memoryloop() {
+	for {
+		free, err := freeMemory()
+		if err != nil {
+			logln(levelWarn, "Free memory check disabled:", err)
+			return
+		}
+		low := free < minFreeMemory
+		was := atomic.LoadInt32(&lowMemory) == 1
+		if low && !was {
+			logf(levelWarn, "Low memory: %d bytes free, no longer adding cache entries", free)
+			atomic.StoreInt32(&lowMemory, 1)
+		} else if !low && was {
+			logf(levelInfo, "Memory recovered: %d bytes free, caching again", free)
+			atomic.StoreInt32(&lowMemory, 0)
+		}
+		time.Sleep(5 * time.Second)
+	}
+}
+
+//freeMemory returns the bytes available to us, preferring the cgroup (v2 then v1)
+//limit when running in a container and falling back to MemAvailable.
+func freeMemory() (int64, error) {
+	if limit, err := readInt("/sys/fs/cgroup/memory.max"); err == nil {
+		if usage, err := readInt("/sys/fs/cgroup/memory.current"); err == nil {
+			return limit - usage, nil
+		}
+	}
+	if limit, err := readInt("/sys/fs/cgroup/memory/memory.limit_in_bytes"); err == nil && limit < 1<<50 {
+		if usage, err := readInt("/sys/fs/cgroup/memory/memory.usage_in_bytes"); err == nil {
+			return limit - usage, nil
+		}
+	}
+	f, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) >= 2 && fields[0] == "MemAvailable:" {
+			kb, err := strconv.ParseInt(fields[1], 10, 64)
+			return kb * 1024, err
+		}
+	}
+	return 0, os.ErrNotExist
+}
+
+//readInt reads a file containing a single integer. "max" (no cgroup limit) is an error.
+func readInt(name string) (int64, error) {
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	metricsPage  = false //Serve Prometheus metrics at /metrics
+	negativeHits int64   //Cached 404s served, accessed atomically
+	staleServed  int64   //Old objects served because Dropbox rejected our credentials, accessed atomically
+	dropboxStats = &apiStats{calls: make(map[string]*apiCall)}
+)
+
+//Upper bounds in seconds of the upstream latency histogram buckets
+var latencyBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+//apiStats counts Dropbox API calls per method
+type apiStats struct {
+	sync.Mutex
+	calls map[string]*apiCall
+}
+
+type apiCall struct {
+	count   int64
+	errors  int64
+	buckets []int64 //Cumulative counts per latencyBuckets
+	sum     float64 //Seconds
+}
+
+//observe records a Dropbox call to method that started at start
+func (s *apiStats) observe(method string, start time.Time, err error) {
+	d := time.Since(start).Seconds()
+	s.Lock()
+	defer s.Unlock()
+	c, ok := s.calls[method]
+	if !ok {
+		c = &apiCall{buckets: make([]int64, len(latencyBuckets))}
+		s.calls[method] = c
+	}
+	c.count++
+	if err != nil {
+		c.errors++
+	}
+	c.sum += d
+	for i, le := range latencyBuckets {
+		if d <= le {
+			c.buckets[i]++
+		}
+	}
+}
+
+//metricsHandler writes the metrics in the Prometheus text format
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	if adminToken != "" && !adminAuthorized(r) {
+		httpError(w, r, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	entries, bytes := dbcache.stats()
+	fmt.Fprintf(w, "# HELP dboxserver_cache_hits_total Requests served from cache.\n# TYPE dboxserver_cache_hits_total counter\ndboxserver_cache_hits_total %d\n", atomic.LoadInt64(&cacheHits))
+	fmt.Fprintf(w, "# HELP dboxserver_cache_misses_total Requests that went to Dropbox.\n# TYPE dboxserver_cache_misses_total counter\ndboxserver_cache_misses_total %d\n", atomic.LoadInt64(&cacheMisses))
+	fmt.Fprintf(w, "# HELP dboxserver_cache_negative_hits_total Cached 404s served.\n# TYPE dboxserver_cache_negative_hits_total counter\ndboxserver_cache_negative_hits_total %d\n", atomic.LoadInt64(&negativeHits))
+	fmt.Fprintf(w, "# HELP dboxserver_cache_entries Objects in the cache.\n# TYPE dboxserver_cache_entries gauge\ndboxserver_cache_entries %d\n", entries)
+	fmt.Fprintf(w, "# HELP dboxserver_cache_bytes Body bytes in the cache.\n# TYPE dboxserver_cache_bytes gauge\ndboxserver_cache_bytes %d\n", bytes)
+	fmt.Fprintf(w, "# HELP dboxserver_shed_requests_total Requests answered 503 because of -max-inflight.\n# TYPE dboxserver_shed_requests_total counter\ndboxserver_shed_requests_total %d\n", atomic.LoadInt64(&shedRequests))
+	fmt.Fprintf(w, "# HELP dboxserver_low_memory 1 while free memory is below -min-free-memory and nothing new is cached.\n# TYPE dboxserver_low_memory gauge\ndboxserver_low_memory %d\n", atomic.LoadInt32(&lowMemory))
+	authFailing := 0
+	if health.authFailing() {
+		authFailing = 1
+	}
+	fmt.Fprintf(w, "# HELP dboxserver_dropbox_auth_failing 1 while Dropbox rejects our credentials.\n# TYPE dboxserver_dropbox_auth_failing gauge\ndboxserver_dropbox_auth_failing %d\n", authFailing)
+	fmt.Fprintf(w, "# HELP dboxserver_stale_served_total Cached versions served because Dropbox rejected our credentials (-serve-stale-on-auth-failure).\n# TYPE dboxserver_stale_served_total counter\ndboxserver_stale_served_total %d\n", atomic.LoadInt64(&staleServed))
+	lastLongpoll, longpollFailures := health.longpollStatus()
+	fmt.Fprintf(w, "# HELP dboxserver_longpoll_last_success_timestamp_seconds Time of the last successful longpoll, of the folder that has gone longest without one.\n# TYPE dboxserver_longpoll_last_success_timestamp_seconds gauge\ndboxserver_longpoll_last_success_timestamp_seconds %d\n", lastLongpoll.Unix())
+	fmt.Fprintf(w, "# HELP dboxserver_longpoll_failures Consecutive failed longpolls, of the folder failing most.\n# TYPE dboxserver_longpoll_failures gauge\ndboxserver_longpoll_failures %d\n", longpollFailures)
+
+	dropboxStats.Lock()
+	defer dropboxStats.Unlock()
+	var methods []string
+	for m := range dropboxStats.calls {
+		methods = append(methods, m)
+	}
+	sort.Strings(methods)
+	fmt.Fprint(w, "# HELP dboxserver_dropbox_calls_total Dropbox API calls.\n# TYPE dboxserver_dropbox_calls_total counter\n")
+	for _, m := range methods {
+		fmt.Fprintf(w, "dboxserver_dropbox_calls_total{method=%q} %d\n", m, dropboxStats.calls[m].count)
+	}
+	fmt.Fprint(w, "# HELP dboxserver_dropbox_errors_total Dropbox API calls that failed.\n# TYPE dboxserver_dropbox_errors_total counter\n")
+	for _, m := range methods {
+		fmt.Fprintf(w, "dboxserver_dropbox_errors_total{method=%q} %d\n", m, dropboxStats.calls[m].errors)
+	}
+	fmt.Fprint(w, "# HELP dboxserver_dropbox_duration_seconds Latency of Dropbox API calls.\n# TYPE dboxserver_dropbox_duration_seconds histogram\n")
+	for _, m := range methods {
+		c := dropboxStats.calls[m]
+		for i, le := range latencyBuckets {
+			fmt.Fprintf(w, "dboxserver_dropbox_duration_seconds_bucket{method=%q,le=\"%g\"} %d\n", m, le, c.buckets[i])
+		}
+		fmt.Fprintf(w, "dboxserver_dropbox_duration_seconds_bucket{method=%q,le=\"+Inf\"} %d\n", m, c.count)
+		fmt.Fprintf(w, "dboxserver_dropbox_duration_seconds_sum{method=%q} %g\n", m, c.sum)
+		fmt.Fprintf(w, "dboxserver_dropbox_duration_seconds_count{method=%q} %d\n", m, c.count)
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/dropbox/dropbox-sdk-go-unofficial/dropbox"
+	"github.com/dropbox/dropbox-sdk-go-unofficial/dropbox/auth"
+)
+
+func TestLowMemoryGauge(t *testing.T) {
+	defer func(m bool) { metricsPage = m }(metricsPage)
+	metricsPage = true
+	h := testHandler(t, newFakeDropbox())
+	for _, low := range []int32{1, 0} {
+		atomic.StoreInt32(&lowMemory, low)
+		body := request(h, "GET", "/metrics").Body.String()
+		if want := fmt.Sprintf("\ndboxserver_low_memory %d\n", low); !strings.Contains(body, want) {
+			t.Errorf("lowMemory %d: no %q in /metrics", low, strings.TrimSpace(want))
+		}
+	}
+}
+
+func TestAuthFailureMetrics(t *testing.T) {
+	defer func(m, stale bool) { metricsPage, serveStaleOnAuthFailure = m, stale }(metricsPage, serveStaleOnAuthFailure)
+	metricsPage = true
+	serveStaleOnAuthFailure = true
+	fake := newFakeDropbox()
+	fake.put("/Public/f.txt", "cached")
+	h := testHandler(t, fake)
+	defer health.setAuthFailure(nil)
+	request(h, "GET", "/f.txt")
+	fake.Lock()
+	fake.errs["/public/f.txt"] = auth.AuthAPIError{APIError: dropbox.APIError{ErrorSummary: "expired_access_token/"}}
+	fake.Unlock()
+	invalidateAll()
+	served := atomic.LoadInt64(&staleServed)
+	w := request(h, "GET", "/f.txt")
+	if w.Code != http.StatusOK || w.Body.String() != "cached" || w.Header().Get("Warning") == "" {
+		t.Errorf("GET = %d %q Warning %q, want the stale 200", w.Code, w.Body.String(), w.Header().Get("Warning"))
+	}
+	if n := atomic.LoadInt64(&staleServed) - served; n != 1 {
+		t.Errorf("%d stale responses counted, want 1", n)
+	}
+	if body := request(h, "GET", "/metrics").Body.String(); !strings.Contains(body, "\ndboxserver_dropbox_auth_failing 1\n") {
+		t.Error("dboxserver_dropbox_auth_failing is not 1")
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+var (
+	defaultContentType = "application/octet-stream" //-default-content-type, for unknown extensions
+	sniffContent       = false                      //-sniff-content-type, guess unknown types from the body
+)
+
+//mimeTypes are checked before the OS mime database, which often lacks (or has
+//outdated types for) these web formats. -mime adds to and overrides them.
+var mimeTypes = map[string]string{
+	".js":          "text/javascript; charset=utf-8",
+	".mjs":         "text/javascript; charset=utf-8",
+	".css":         "text/css; charset=utf-8",
+	".json":        "application/json",
+	".map":         "application/json",
+	".wasm":        "application/wasm",
+	".webmanifest": "application/manifest+json",
+	".svg":         "image/svg+xml",
+	".webp":        "image/webp",
+	".avif":        "image/avif",
+	".woff":        "font/woff",
+	".woff2":       "font/woff2",
+	".md":          "text/markdown; charset=utf-8",
+	".yaml":        "text/yaml; charset=utf-8",
+	".yml":         "text/yaml; charset=utf-8",
+}
+
+//parseMimeOverrides adds -mime values, .ext=type, to mimeTypes
+func parseMimeOverrides(specs []string) error {
+	for _, spec := range specs {
+		kv := strings.SplitN(spec, "=", 2)
+		ext := strings.ToLower(strings.TrimSpace(kv[0]))
+		if len(kv) != 2 || !strings.HasPrefix(ext, ".") || len(ext) < 2 || strings.TrimSpace(kv[1]) == "" {
+			return fmt.Errorf("invalid -mime %q, want .ext=type", spec)
+		}
+		mimeTypes[ext] = strings.TrimSpace(kv[1])
+	}
+	return nil
+}
+
+//sniffContentType replaces the default type of a cached obj whose extension is
+//unknown with what http.DetectContentType makes of its body, for
+//-sniff-content-type. Streamed files have no body to look at and keep the
+//default.
+func sniffContentType(obj *cacheobj, key string) {
+	if !sniffContent || len(obj.data) == 0 || typeByExtension(key) != "" {
+		return
+	}
+	if ct := http.DetectContentType(obj.data); ct != "application/octet-stream" {
+		//Otherwise it couldn't tell, keep the default
+		obj.contentType = ct
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+//mount serves a Dropbox folder under a URL prefix
+type mount struct {
+	prefix string //URL prefix, lower case without trailing slash, "" for /
+	folder string //Dropbox folder
+}
+
+var mounts []mount //Longest prefix first, see -mount. Defaults to folder at /
+
+//parseMounts parses -mount values like /pub:/Public
+func parseMounts(specs []string) error {
+	for _, spec := range specs {
+		kv := strings.SplitN(spec, ":", 2)
+		if len(kv) != 2 || !strings.HasPrefix(kv[0], "/") {
+			return fmt.Errorf("invalid mount %q, expected /prefix:/Dropbox/folder", spec)
+		}
+		prefix := strings.TrimSuffix(strings.ToLower(cleanPath(kv[0])), "/")
+		folder := strings.TrimSuffix(kv[1], "/")
+		if folder != "" && !strings.HasPrefix(folder, "/") {
+			return fmt.Errorf("invalid mount %q, the Dropbox folder must start with /", spec)
+		}
+		for _, m := range mounts {
+			if m.prefix == prefix {
+				return fmt.Errorf("duplicate mount for %s/", prefix)
+			}
+		}
+		mounts = append(mounts, mount{prefix: prefix, folder: folder})
+	}
+	sort.Slice(mounts, func(i, j int) bool {
+		return len(mounts[i].prefix) > len(mounts[j].prefix)
+	})
+	return nil
+}
+
+//dropboxPath maps key (a url path) to its Dropbox path using the longest
+//matching mount. Returns "" if key is not under any mount.
+func dropboxPath(key string) string {
+	lkey := strings.ToLower(key)
+	for _, m := range mounts {
+		if m.prefix == "" || lkey == m.prefix || strings.HasPrefix(lkey, m.prefix+"/") {
+			return m.folder + key[len(m.prefix):]
+		}
+	}
+	return ""
+}
+
+//watchedFolders returns the distinct mounted Dropbox folders
+func watchedFolders() []string {
+	seen := make(map[string]bool)
+	var folders []string
+	for _, m := range mounts {
+		lf := strings.ToLower(m.folder)
+		if !seen[lf] {
+			seen[lf] = true
+			folders = append(folders, m.folder)
+		}
+	}
+	return folders
+}
+
+//urlKeys maps a PathLower from the listing of folder back to the (lower case)
+//url keys it is served under
+func urlKeys(folder, pathLower string) []string {
+	lf := strings.ToLower(folder)
+	if !strings.HasPrefix(pathLower, lf+"/") {
+		return nil
+	}
+	rest := pathLower[len(lf):]
+	var keys []string
+	for _, m := range mounts {
+		if strings.ToLower(m.folder) == lf {
+			keys = append(keys, m.prefix+rest)
+		}
+	}
+	return keys
+}
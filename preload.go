@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+//preloadPaths parses -preload: a comma separated list of paths, or @file with
+//one path per line (blank lines and # comments are skipped)
+func preloadPaths(spec string) ([]string, error) {
+	if !strings.HasPrefix(spec, "@") {
+		return strings.Split(spec, ","), nil
+	}
+	b, err := ioutil.ReadFile(spec[1:])
+	if err != nil {
+		return nil, err
+	}
+	return strings.Split(string(b), "\n"), nil
+}
+
+//preload fetches paths into the cache through the normal fill path, so a fresh
+//instance doesn't start cold
+func preload(paths []string) {
+	var todo []string
+	for _, p := range paths {
+		p = strings.TrimSpace(p)
+		if p != "" && !strings.HasPrefix(p, "#") {
+			todo = append(todo, p)
+		}
+	}
+	failed := batch("Preload", todo, preloadPath)
+	logf(levelInfo, "Preloaded %d paths, %d failed", len(todo)-failed, failed)
+}
+
+//preloadPath fetches p into the cache unless it's there and fresh
+func preloadPath(p string) error {
+	key := cleanPath(p)
+	if strings.HasSuffix(key, "/") {
+		key += indexFile
+	}
+	r, err := http.NewRequest(http.MethodGet, key, nil)
+	if err != nil {
+		return err
+	}
+	ck := cacheKey(r, key)
+	old, _ := dbcache.Get(ck)
+	if old != nil && old.exists && !old.stale() {
+		return nil
+	}
+	//With -cache-dir, old is the reloaded copy, only downloaded again if its rev changed
+	res, err := fills.do(r, ck, func(ctx context.Context) (fetchResult, error) {
+		return fetch(ctx, r, key, old, false)
+	})
+	switch {
+	case err != nil:
+		return err
+	case res.stream:
+		return errors.New("is too big to cache")
+	case !res.obj.exists:
+		return errors.New("not found")
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//byteRange is an inclusive range of bytes
+type byteRange struct {
+	start, end int64
+}
+
+func (b byteRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", b.start, b.end, size)
+}
+
+//parseSingleRange parses a Range header against a resource of size bytes.
+//ok is false if the range should be ignored (absent, malformed or multiple
+//ranges, which we answer with the full body). unsatisfiable means 416.
+func parseSingleRange(header string, size int64) (br byteRange, ok bool, unsatisfiable bool) {
+	if !strings.HasPrefix(header, "bytes=") {
+		return br, false, false
+	}
+	spec := strings.TrimSpace(strings.TrimPrefix(header, "bytes="))
+	if strings.Contains(spec, ",") {
+		return br, false, false
+	}
+	dash := strings.Index(spec, "-")
+	if dash < 0 {
+		return br, false, false
+	}
+	first, last := strings.TrimSpace(spec[:dash]), strings.TrimSpace(spec[dash+1:])
+	if first == "" {
+		//Suffix range: last N bytes
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n < 0 {
+			return br, false, false
+		}
+		if n == 0 || size == 0 {
+			return br, true, true
+		}
+		if n > size {
+			n = size
+		}
+		return byteRange{size - n, size - 1}, true, false
+	}
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 {
+		return br, false, false
+	}
+	end := size - 1
+	if last != "" {
+		end, err = strconv.ParseInt(last, 10, 64)
+		if err != nil || end < start {
+			return br, false, false
+		}
+		if end >= size {
+			end = size - 1
+		}
+	}
+	if start >= size {
+		return br, true, true
+	}
+	return byteRange{start, end}, true, false
+}
+
+//ifRangeMatches reports whether a Range request may be honored given If-Range,
+//which carries either an etag or a date of the version the client has.
+func ifRangeMatches(r *http.Request, obj *cacheobj) bool {
+	ir := r.Header.Get("If-Range")
+	if ir == "" {
+		return true
+	}
+	if t, err := http.ParseTime(ir); err == nil {
+		//Only an exact match of Last-Modified, like ServeContent does for cached files
+		return obj.entry.ServerModified.Truncate(time.Second).Equal(t)
+	}
+	//Strong comparison only
+	return !strings.HasPrefix(ir, "W/") && strings.Trim(ir, `"`) == obj.entry.Rev
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIfRange(t *testing.T) {
+	for _, streamed := range []bool{false, true} {
+		fake := newFakeDropbox()
+		file := fake.put("/Public/f.bin", "0123456789")
+		etag := `"` + file.rev + `"`
+		date := file.modified.Format(http.TimeFormat)
+		tests := []struct {
+			name    string
+			ifRange string
+			status  int
+			body    string
+		}{
+			{"none", "", http.StatusPartialContent, "234"},
+			{"etag match", etag, http.StatusPartialContent, "234"},
+			{"etag mismatch", `"other"`, http.StatusOK, "0123456789"},
+			{"weak etag", "W/" + etag, http.StatusOK, "0123456789"},
+			{"date match", date, http.StatusPartialContent, "234"},
+			{"date mismatch", file.modified.Add(-time.Hour).Format(http.TimeFormat), http.StatusOK, "0123456789"},
+		}
+		for _, tt := range tests {
+			name := "cached/" + tt.name
+			if streamed {
+				name = "streamed/" + tt.name
+			}
+			t.Run(name, func(t *testing.T) {
+				if streamed {
+					old := maxCacheSize
+					maxCacheSize = 4
+					defer func() { maxCacheSize = old }()
+				}
+				h := testHandler(t, fake)
+				header := []string{"Range", "bytes=2-4"}
+				if tt.ifRange != "" {
+					header = append(header, "If-Range", tt.ifRange)
+				}
+				w := request(h, "GET", "/f.bin", header...)
+				if w.Code != tt.status || w.Body.String() != tt.body {
+					t.Errorf("= %d %q, want %d %q", w.Code, w.Body.String(), tt.status, tt.body)
+				}
+				if tt.status == http.StatusPartialContent && w.Header().Get("Content-Range") != "bytes 2-4/10" {
+					t.Errorf("Content-Range %q", w.Header().Get("Content-Range"))
+				}
+			})
+		}
+	}
+}
+
+func TestRangeBypassesCompression(t *testing.T) {
+	fake := newFakeDropbox()
+	body := strings.Repeat("compressible text ", 500)
+	fake.put("/Public/f.txt", body)
+	h := testHandler(t, fake)
+	for _, enc := range []string{"gzip", "br", "gzip, br"} {
+		w := request(h, "GET", "/f.txt", "Range", "bytes=100-199", "Accept-Encoding", enc)
+		if w.Code != http.StatusPartialContent {
+			t.Fatalf("Accept-Encoding %s: %d, want 206", enc, w.Code)
+		}
+		if ce := w.Header().Get("Content-Encoding"); ce != "" {
+			t.Errorf("Accept-Encoding %s: Content-Encoding %q on a 206", enc, ce)
+		}
+		if w.Body.String() != body[100:200] {
+			t.Errorf("Accept-Encoding %s: body %q, want identity bytes 100-199", enc, w.Body.String())
+		}
+		if cr := w.Header().Get("Content-Range"); cr != fmt.Sprintf("bytes 100-199/%d", len(body)) {
+			t.Errorf("Accept-Encoding %s: Content-Range %q", enc, cr)
+		}
+		if !strings.Contains(strings.Join(w.Header()["Vary"], ","), "Accept-Encoding") {
+			t.Errorf("Accept-Encoding %s: no Vary: Accept-Encoding", enc)
+		}
+	}
+	//The same URL without Range is still compressed
+	if w := request(h, "GET", "/f.txt", "Accept-Encoding", "gzip"); w.Header().Get("Content-Encoding") != "gzip" {
+		t.Errorf("full GET Content-Encoding %q, want gzip", w.Header().Get("Content-Encoding"))
+	}
+}
+
+//Cached files answer several ranges as multipart/byteranges, streamed ones
+//with the whole body, which is also valid
+func TestMultiRange(t *testing.T) {
+	fake := newFakeDropbox()
+	fake.put("/Public/f.bin", "0123456789")
+	h := testHandler(t, fake)
+	w := request(h, "GET", "/f.bin", "Range", "bytes=0-1,5-6")
+	if w.Code != http.StatusPartialContent {
+		t.Fatalf("cached = %d, want 206", w.Code)
+	}
+	mt, params, err := mime.ParseMediaType(w.Header().Get("Content-Type"))
+	if err != nil || mt != "multipart/byteranges" {
+		t.Fatalf("Content-Type %q, want multipart/byteranges", w.Header().Get("Content-Type"))
+	}
+	mr := multipart.NewReader(w.Body, params["boundary"])
+	want := []struct{ contentRange, body string }{
+		{"bytes 0-1/10", "01"},
+		{"bytes 5-6/10", "56"},
+	}
+	for i, part := range want {
+		p, err := mr.NextPart()
+		if err != nil {
+			t.Fatalf("part %d: %v", i, err)
+		}
+		body, _ := ioutil.ReadAll(p)
+		if p.Header.Get("Content-Range") != part.contentRange || string(body) != part.body {
+			t.Errorf("part %d: Content-Range %q body %q, want %q %q", i, p.Header.Get("Content-Range"), body, part.contentRange, part.body)
+		}
+	}
+	if _, err := mr.NextPart(); err != io.EOF {
+		t.Errorf("after the parts: %v, want EOF", err)
+	}
+
+	defer func(n int64) { maxCacheSize = n }(maxCacheSize)
+	maxCacheSize = 4
+	h = testHandler(t, fake)
+	w = request(h, "GET", "/f.bin", "Range", "bytes=0-1,5-6")
+	if w.Code != http.StatusOK || w.Body.String() != "0123456789" || w.Header().Get("Content-Range") != "" {
+		t.Errorf("streamed = %d %q Content-Range %q, want 200 with the full body", w.Code, w.Body.String(), w.Header().Get("Content-Range"))
+	}
+}
+
+func TestParseSingleRangeMultiple(t *testing.T) {
+	if _, ok, unsatisfiable := parseSingleRange("bytes=0-1,5-6", 10); ok || unsatisfiable {
+		t.Errorf("parseSingleRange(0-1,5-6) ok %v unsatisfiable %v, want the range ignored", ok, unsatisfiable)
+	}
+}
+
+//A range starting past the end is a 416 telling the size, cached or streamed
+func TestUnsatisfiableRange(t *testing.T) {
+	for _, streamed := range []bool{false, true} {
+		fake := newFakeDropbox()
+		fake.put("/Public/f.bin", "0123456789")
+		if streamed {
+			old := maxCacheSize
+			maxCacheSize = 4
+			defer func() { maxCacheSize = old }()
+		}
+		h := testHandler(t, fake)
+		w := request(h, "GET", "/f.bin", "Range", "bytes=99999999-")
+		if w.Code != http.StatusRequestedRangeNotSatisfiable {
+			t.Errorf("streamed=%v: = %d, want 416", streamed, w.Code)
+		}
+		if cr := w.Header().Get("Content-Range"); cr != "bytes */10" {
+			t.Errorf("streamed=%v: Content-Range %q, want bytes */10", streamed, cr)
+		}
+		if n := fake.count("download"); streamed && n != 0 {
+			t.Errorf("streamed: %d downloads for a 416, want none", n)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	rateLimit      = 0.0   //Requests per second per client IP, 0 disables
+	rateBurst      = 20    //Bucket size
+	rateMissesOnly = false //Only cache misses take tokens
+	limiter        = &ipLimiter{buckets: make(map[string]*bucket)}
+)
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+//ipLimiter is a token bucket per client IP
+type ipLimiter struct {
+	sync.Mutex
+	buckets map[string]*bucket
+}
+
+//allow takes a token for ip, or returns how long until one is available
+func (l *ipLimiter) allow(ip string) (bool, time.Duration) {
+	l.Lock()
+	defer l.Unlock()
+	now := time.Now()
+	b, ok := l.buckets[ip]
+	if !ok {
+		b = &bucket{tokens: float64(rateBurst), last: now}
+		l.buckets[ip] = b
+	}
+	b.tokens = math.Min(float64(rateBurst), b.tokens+now.Sub(b.last).Seconds()*rateLimit)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / rateLimit * float64(time.Second))
+}
+
+//cleanuploop forgets clients whose bucket has refilled, so the map doesn't grow forever
+func (l *ipLimiter) cleanuploop() {
+	full := time.Duration(float64(rateBurst) / rateLimit * float64(time.Second))
+	for sleep(time.Minute) {
+		l.Lock()
+		for ip, b := range l.buckets {
+			if time.Since(b.last) > full {
+				delete(l.buckets, ip)
+			}
+		}
+		l.Unlock()
+	}
+}
+
+//rateLimited enforces the per IP rate limit, writing a 429 and returning true
+//if r is over it
+func rateLimited(w http.ResponseWriter, r *http.Request) bool {
+	if rateLimit <= 0 {
+		return false
+	}
+	ok, wait := limiter.allow(clientIP(r))
+	if ok {
+		return false
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	httpError(w, r, "Too many requests", http.StatusTooManyRequests)
+	return true
+}
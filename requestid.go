@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+)
+
+type requestIDKey struct{}
+
+//validRequestID reports whether an X-Request-ID from the client (or a proxy)
+//is safe to echo and log: short, and only letters, digits and -_.:
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.' || c == ':') {
+			return false
+		}
+	}
+	return true
+}
+
+//withRequestID gives every request an id, the client's X-Request-ID if it sent a
+//usable one, and echoes it in the X-Request-ID response header
+func withRequestID(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if !validRequestID(id) {
+			b := make([]byte, 8)
+			rand.Read(b)
+			id = hex.EncodeToString(b)
+		}
+		w.Header().Set("X-Request-ID", id)
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
+
+//requestID returns the id of r, "" outside withRequestID
+func requestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDKey{}).(string)
+	return id
+}
+
+//logRequest logs errors while serving r (at levelError), tagged with its id
+func logRequest(r *http.Request, v ...interface{}) {
+	logRequestAt(levelError, r, v...)
+}
+
+//logRequestAt is logRequest at another level
+func logRequestAt(level logLevel, r *http.Request, v ...interface{}) {
+	if id := requestID(r); id != "" {
+		v = append([]interface{}{"req=" + id}, v...)
+	}
+	logln(level, v...)
+}
+
+//detachedContext is a context for work that outlives r, keeping its id
+func detachedContext(r *http.Request) context.Context {
+	return context.WithValue(context.Background(), requestIDKey{}, requestID(r))
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/dropbox/dropbox-sdk-go-unofficial/dropbox/auth"
+	"golang.org/x/oauth2"
+)
+
+var (
+	rateLimitRetries = 2               //Retries of a Dropbox call that was rate limited
+	rateLimitMaxWait = 5 * time.Second //Cap on Retry-After we wait for, the client is waiting
+)
+
+//retryRateLimited calls fn, and again after Dropbox's Retry-After for as long as
+//it is rate limited, up to rateLimitRetries times
+func retryRateLimited(fn func() error) error {
+	for i := 0; ; i++ {
+		err := fn()
+		rl, ok := err.(auth.RateLimitAPIError)
+		if !ok || i >= rateLimitRetries {
+			return err
+		}
+		d := retryAfter(rl)
+		logln(levelWarn, "Rate limited by Dropbox, retrying in", d)
+		if !sleep(d) {
+			return err
+		}
+	}
+}
+
+//retryAfter is how long Dropbox asked us to wait, capped at rateLimitMaxWait
+func retryAfter(e auth.RateLimitAPIError) time.Duration {
+	d := time.Second
+	if e.RateLimitError != nil && e.RateLimitError.RetryAfter > 0 {
+		d = time.Duration(e.RateLimitError.RetryAfter) * time.Second
+	}
+	if d > rateLimitMaxWait {
+		d = rateLimitMaxWait
+	}
+	return d
+}
+
+//upstreamError reports a failed Dropbox call to the client: 503 with Retry-After
+//if we are rate limited or too busy, 500 if Dropbox rejects our credentials
+//(our config is broken) or answers with metadata we don't handle, 504 if it timed out and 502 for any other failure
+func upstreamError(w http.ResponseWriter, r *http.Request, err error) {
+	if rl, ok := err.(auth.RateLimitAPIError); ok {
+		secs := uint64(1)
+		if rl.RateLimitError != nil && rl.RateLimitError.RetryAfter > 0 {
+			secs = rl.RateLimitError.RetryAfter
+		}
+		w.Header().Set("Retry-After", strconv.FormatUint(secs, 10))
+		httpError(w, r, "Rate limited by Dropbox, try again later", http.StatusServiceUnavailable)
+		return
+	}
+	if err == errUpstreamBusy {
+		w.Header().Set("Retry-After", "1")
+		httpError(w, r, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	var re *oauth2.RetrieveError
+	var ue unexpectedMetadataError
+	if _, ok := err.(auth.AuthAPIError); ok || errors.As(err, &re) || errors.As(err, &ue) {
+		httpError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var ne net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &ne) && ne.Timeout()) {
+		httpError(w, r, "Dropbox timed out", http.StatusGatewayTimeout)
+		return
+	}
+	httpError(w, r, err.Error(), http.StatusBadGateway)
+}
+
+var (
+	upstreamSlots   chan struct{} //Semaphore bounding concurrent Dropbox fetches, see -max-upstream-concurrency
+	upstreamWait    = 5 * time.Second
+	errUpstreamBusy = fmt.Errorf("Too many concurrent Dropbox requests")
+)
+
+//upstream runs fn, one Dropbox call or a few that belong together, in an
+//upstream slot and retrying while rate limited. Everything but the cache fills
+//(which hold their slot for the whole fill) goes through it, so
+//-max-upstream-concurrency really bounds what we ask of Dropbox.
+func upstream(ctx context.Context, fn func() error) error {
+	release, err := acquireUpstream(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+	return retryRateLimited(fn)
+}
+
+//acquireUpstream waits for a free Dropbox fetch slot, giving up after
+//upstreamWait or when ctx is canceled. Call the returned func when done, it
+//may be called more than once.
+func acquireUpstream(ctx context.Context) (func(), error) {
+	if upstreamSlots == nil {
+		return func() {}, nil
+	}
+	t := time.NewTimer(upstreamWait)
+	defer t.Stop()
+	select {
+	case upstreamSlots <- struct{}{}:
+		var once sync.Once
+		return func() { once.Do(func() { <-upstreamSlots }) }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-t.C:
+		return nil, errUpstreamBusy
+	}
+}
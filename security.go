@@ -0,0 +1,37 @@
+package main
+
+import "net/http"
+
+var (
+	nosniff        = false //-nosniff, send X-Content-Type-Options: nosniff
+	frameOptions   = ""    //-frame-options, X-Frame-Options value
+	referrerPolicy = ""    //-referrer-policy, Referrer-Policy value
+	csp            = ""    //-csp, Content-Security-Policy value
+	serverHeader   = ""    //-server-header, net/http sends no Server header by itself
+)
+
+//securityHeaders adds the configured security headers to every response
+func securityHeaders(h http.Handler) http.Handler {
+	if !nosniff && frameOptions == "" && referrerPolicy == "" && csp == "" && serverHeader == "" {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if nosniff {
+			//Our content types are guessed from the extension, browsers must not second guess them
+			w.Header().Set("X-Content-Type-Options", "nosniff")
+		}
+		if frameOptions != "" {
+			w.Header().Set("X-Frame-Options", frameOptions)
+		}
+		if referrerPolicy != "" {
+			w.Header().Set("Referrer-Policy", referrerPolicy)
+		}
+		if csp != "" {
+			w.Header().Set("Content-Security-Policy", csp)
+		}
+		if serverHeader != "" {
+			w.Header().Set("Server", serverHeader)
+		}
+		h.ServeHTTP(w, r)
+	})
+}
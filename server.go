@@ -1,58 +1,208 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha512"
 	"crypto/tls"
+	"encoding/base64"
 	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"math/rand"
 	"mime"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"path"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/NYTimes/gziphandler"
 	"github.com/dropbox/dropbox-sdk-go-unofficial/dropbox"
+	"github.com/dropbox/dropbox-sdk-go-unofficial/dropbox/auth"
 	"github.com/dropbox/dropbox-sdk-go-unofficial/dropbox/files"
 	"golang.org/x/crypto/acme/autocert"
+	"golang.org/x/oauth2"
 )
 
 var (
-	db           files.Client
-	lmod         = time.Now()
-	errNotCached = fmt.Errorf("Object not found in cache")
-	dbcache      = newcache()
-	maxCacheSize = 1 * 1024 * 1024 //Max 1MB objects will be cached
-	folder       = "/Public"
+	db                       dropboxClient
+	lmod                                        = time.Now().UnixNano() //Last invalidation of everything, accessed atomically, see lastInvalidation
+	errNotCached                                = fmt.Errorf("Object not found in cache")
+	dbcache                                     = newcache()
+	maxCacheSize             int64              = 1 * 1024 * 1024 //Max 1MB objects will be cached, see -max-cache-size
+	folder                                      = "/Public"
+	classBudgets                                = make(map[string]int64) //Max bytes cached per content type class (image, text, ...)
+	preloadLinks                                = false                  //Emit Link headers for html from <path>.links sidecar files
+	ready                    int32                                       //Set to 1 once we have a longpoll cursor, accessed atomically
+	startupRetries           = 5                                         //Fast retries for the initial cursor
+	longpollMinInterval      = 5 * time.Second                           //Minimum time between the starts of two longpoll cycles
+	indexFile                = "index.html"                              //Served for paths ending in /
+	canonicalIndex           = false                                     //301 /dir/index.html to /dir/
+	cacheKeyParams           []string                                    //Query params that affect the response and are part of the cache key
+	wellKnownDir                                = ""                     //Serve /.well-known/ from this local directory instead of Dropbox
+	maxPathLength                               = 1024                   //Longest Dropbox path (folder + request path) we will look up
+	refreshes                                   = &inflight{keys: make(map[string]bool)}
+	sriHeader                                   = false //Send the SRI hash of every file in X-Integrity
+	hashContent                                 = false //Compute a sha384 of every cached body at fill time
+	tlsSessionTickets                           = true
+	tlsMinVersion            uint16             = tls.VersionTLS12
+	keepAlives                                  = true
+	quit                                        = make(chan struct{}) //Closed on shutdown, background loops exit
+	shutdownTimeout                             = 15 * time.Second
+	serveStaleOnAuthFailure                     = false //Keep serving cached objects while Dropbox rejects our credentials
+	extraVary                []string                   //Extra Vary header values, for setups where a CDN varies on a custom header
+	staleWindow              = 10 * time.Second         //How long after an invalidation a stale object may be served while it is re-fetched
+	fills                    = &fetchGroup{calls: make(map[string]*fetchCall)}
+	cacheControl             = ""                                     //Cache-Control for found objects, "" sends none
+	notFoundCacheControl     = "public, max-age=60"                   //Cache-Control for 404s when cacheControl is set
+	surrogateControl         = ""                                     //-surrogate-control, for CDNs, "" sends none
+	notFoundSurrogateControl = "max-age=60"                           //-surrogate-control-404, when surrogateControl is set
+	surrogateHeader          = "Surrogate-Control"                    //-surrogate-header, e.g. CDN-Cache-Control
+	honorNoCache             = false                                  //-honor-no-cache, a client Cache-Control: no-cache skips the cache
+	noCacheInterval          = 10 * time.Second                       //-honor-no-cache-interval, least time between two forced refreshes of a file
+	negativeTTL              = time.Minute                            //Cached 404s are re-checked with Dropbox after this long
+	notFoundPage             = "/404.html"                            //Served as the body of 404s if it exists, "" disables
+	rootRedirect             = ""                                     //If set / redirects here, e.g. https://github.com/sajal/dboxserver
+	forceHTTPS               = false                                  //-force-https, redirect plain http requests on -addr
+	basePath                 string                                   //-base-path, URL prefix stripped from every request
+	maxFileSize              int64                                    //-max-file-size, 0 for no limit
+	caseSensitiveCache       bool                                     //-case-sensitive-cache, keep the case of paths in cache keys
+	spaFallback              string                                   //-spa-fallback, entrypoint of a single page app
+	pollMode                 = "longpoll"                             //-poll-mode: longpoll, ttl or off
+	pollTTL                  time.Duration                            //-poll-ttl, max age of cached files in -poll-mode ttl
+	staleWhileRevalidate     bool                                     //-stale-while-revalidate
+	robots                                          = "disallow"      //robots.txt mode: disallow, allow or file
+	favicon                                         = ""              //-favicon: "" from Dropbox, "none" or the path of the icon in the folder
+	longpollBackoffMin                              = 2 * time.Second //First retry delay after a failed longpoll
+	longpollTimeout          uint64                 = 300             //Seconds a longpoll waits for changes, Dropbox allows 30 to 480
+	longpollBackoffMax                              = 5 * time.Minute //Retry delay cap while longpoll keeps failing
 )
 
-type cache struct {
-	*sync.RWMutex
-	data map[string]*cacheobj
+//-read-header-timeout etc. of the http servers
+var (
+	readHeaderTimeout time.Duration
+	readTimeout       time.Duration
+	writeTimeout      time.Duration
+	idleTimeout       time.Duration
+)
+
+//inflight tracks keys that are being re-fetched after an invalidation
+type inflight struct {
+	sync.Mutex
+	keys map[string]bool
+}
+
+//start claims key, returns false if it is already being re-fetched
+func (f *inflight) start(key string) bool {
+	f.Lock()
+	defer f.Unlock()
+	if f.keys[key] {
+		return false
+	}
+	f.keys[key] = true
+	return true
+}
+
+func (f *inflight) done(key string) {
+	f.Lock()
+	delete(f.keys, key)
+	f.Unlock()
 }
 
-func newcache() *cache {
-	return &cache{&sync.RWMutex{}, make(map[string]*cacheobj)}
+//fetchGroup coalesces concurrent cache fills of the same key, so a popular
+//object expiring costs one Dropbox round trip instead of one per client
+type fetchGroup struct {
+	sync.Mutex
+	calls map[string]*fetchCall
 }
 
-func (c *cache) Get(key string) (*cacheobj, error) {
-	c.RLock()
-	defer c.RUnlock()
-	obj, ok := c.data[key]
-	if ok {
-		return obj, nil
+type fetchCall struct {
+	wg     sync.WaitGroup
+	res    fetchResult
+	err    error
+	cancel context.CancelFunc //Cancels the fetch, once every request waiting on it is gone
+	refs   int                //Requests still waiting on it, guarded by the group lock
+}
+
+//do runs fn for key, or if that is already running waits for it and returns
+//the same result (or error). The context passed to fn is canceled when the
+//clients of r and of all requests that joined it have gone away.
+func (g *fetchGroup) do(r *http.Request, key string, fn func(ctx context.Context) (fetchResult, error)) (fetchResult, error) {
+	g.Lock()
+	if c, ok := g.calls[key]; ok && c.refs > 0 {
+		c.refs++
+		g.Unlock()
+		stop := g.watch(r, c)
+		c.wg.Wait()
+		stop()
+		return c.res, c.err
 	}
-	return nil, errNotCached
+	ctx, cancel := context.WithCancel(context.Background())
+	//err is overwritten by fn, unless it panics
+	c := &fetchCall{err: fmt.Errorf("fetching %s failed", key), cancel: cancel, refs: 1}
+	c.wg.Add(1)
+	g.calls[key] = c
+	g.Unlock()
+	stop := g.watch(r, c)
+	defer func() {
+		stop()
+		g.Lock()
+		//An abandoned call may have been replaced already
+		if g.calls[key] == c {
+			delete(g.calls, key)
+		}
+		g.Unlock()
+		cancel()
+		c.wg.Done()
+	}()
+	c.res, c.err = fn(ctx)
+	return c.res, c.err
 }
 
-func (c *cache) Set(key string, obj *cacheobj) error {
-	c.Lock()
-	defer c.Unlock()
-	c.data[key] = obj
-	return nil
+//watch drops r's reference to c when its client goes away, canceling c when it
+//was the last one. Call stop once r no longer waits on c.
+func (g *fetchGroup) watch(r *http.Request, c *fetchCall) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-r.Context().Done():
+			g.Lock()
+			c.refs--
+			last := c.refs == 0
+			g.Unlock()
+			if last {
+				c.cancel()
+			}
+		case <-done:
+		}
+	}()
+	return func() { close(done) }
+}
+
+//closeOnDone closes rd when ctx is canceled, so a blocked Read returns. Call
+//stop once done reading.
+func closeOnDone(ctx context.Context, rd io.Closer) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			rd.Close()
+		case <-done:
+		}
+	}()
+	return func() { close(done) }
 }
 
 type cacheobj struct {
@@ -63,152 +213,1208 @@ type cacheobj struct {
 	contentType string    //Content-Type
 	exists      bool      //Used to cache 404
 	entry       *files.FileMetadata
+	links       []string //Link header values from the .links sidecar
+	suggestions []string //Similarly named paths, for 404s
+	hash        []byte   //sha384 of data, computed once at fill time if hashContent
+	listing     bool     //404 of a directory index, data is the JSON listing of the directory
+	folder      bool     //The path is a Dropbox folder, redirected to the trailing slash URL
+	encMu       sync.Mutex
+	encodings   map[string][]byte //Compressed copies of data by content coding, made on first use
+	siblings    map[string]bool   //Content codings in encodings that are -precompressed siblings, not our own
+	siblingsAt  time.Time         //When the missing siblings were last looked for
+	key         string            //Cache key, set by the cache
+	accounted   int64             //Bytes the cache counts for it, guarded by the cache lock
+}
+
+//lastInvalidation is when everything cached was last invalidated
+func lastInvalidation() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&lmod))
+}
+
+//stale reports whether obj must be re-fetched: it predates the last invalidation,
+//is older than pollTTL in -poll-mode ttl, or it is a 404 older than negativeTTL
+func (o *cacheobj) stale() bool {
+	return o.lastFetch.Before(lastInvalidation()) || o.expired() != ""
+}
+
+//expired returns the trigger of the invalidation event a refetch of o is:
+//"ttl" when it reached pollTTL in -poll-mode ttl, "negative-ttl" for a 404
+//older than negativeTTL. "" if it is stale by an invalidation (already
+//logged) or not at all.
+func (o *cacheobj) expired() string {
+	if o.lastFetch.Before(lastInvalidation()) {
+		return ""
+	}
+	if pollMode == "ttl" && time.Since(o.lastFetch) > pollTTL {
+		return "ttl"
+	}
+	if !o.exists && negativeTTL > 0 && time.Since(o.lastFetch) > negativeTTL {
+		return "negative-ttl"
+	}
+	return ""
+}
+
+//staleFor is how long ago obj became stale, by an invalidation or by reaching
+//pollTTL in -poll-mode ttl
+func (o *cacheobj) staleFor() time.Duration {
+	var d time.Duration
+	if inv := lastInvalidation(); o.lastFetch.Before(inv) {
+		d = time.Since(inv)
+	}
+	if pollMode == "ttl" {
+		if ttl := time.Since(o.lastFetch) - pollTTL; ttl > d {
+			d = ttl
+		}
+	}
+	return d
+}
+
+//forceRefresh reports whether r asks not to be served the cached obj, with
+//Cache-Control no-cache or no-store (or Pragma: no-cache), and gets its way:
+//only with -honor-no-cache, for files (cached 404s are re-checked after
+//negativeTTL anyway) fetched longer than noCacheInterval ago. Browsers send
+//no-cache on every reload, without those limits any client could make every
+//request go to Dropbox.
+func forceRefresh(r *http.Request, obj *cacheobj) bool {
+	if !honorNoCache || (r.Method != http.MethodGet && r.Method != http.MethodHead) {
+		return false
+	}
+	if !obj.exists || time.Since(obj.lastFetch) < noCacheInterval {
+		return false
+	}
+	for _, v := range r.Header.Values("Cache-Control") {
+		for _, d := range strings.Split(v, ",") {
+			d = strings.ToLower(strings.TrimSpace(d))
+			if d == "no-cache" || d == "no-store" {
+				return true
+			}
+		}
+	}
+	return r.Header.Get("Cache-Control") == "" && strings.EqualFold(r.Header.Get("Pragma"), "no-cache")
+}
+
+//class returns the content type class (the part before the "/") used for per class budgets
+func (o *cacheobj) class() string {
+	if o.contentType == "" {
+		return ""
+	}
+	return strings.SplitN(o.contentType, "/", 2)[0]
+}
+
+//sri returns the Subresource Integrity value for the hash of data
+func (o *cacheobj) sri() string {
+	return "sha384-" + base64.StdEncoding.EncodeToString(o.hash)
+}
+
+//parseSize parses human readable sizes like "512KB", "4MB" or "1024"
+func parseSize(s string) (int64, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	mult := int64(1)
+	for _, u := range []struct {
+		suffix string
+		mult   int64
+	}{{"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"B", 1}} {
+		if strings.HasSuffix(s, u.suffix) {
+			s = strings.TrimSpace(strings.TrimSuffix(s, u.suffix))
+			mult = u.mult
+			break
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	if n <= 0 {
+		return 0, fmt.Errorf("size must be positive")
+	}
+	return n * mult, nil
+}
+
+//cleanPath returns the canonical form of a request path: duplicate slashes
+//collapsed, . and .. resolved (never above /), and a trailing slash kept since
+//it means "directory index".
+func cleanPath(p string) string {
+	if p == "" {
+		return "/"
+	}
+	clean := path.Clean("/" + p)
+	if strings.HasSuffix(p, "/") && clean != "/" {
+		clean += "/"
+	}
+	return clean
+}
+
+//validPath rejects paths Dropbox can't have: control characters (including NUL)
+//and invalid UTF-8. Traversal is taken care of by cleanPath.
+func validPath(p string) bool {
+	if !utf8.ValidString(p) {
+		return false
+	}
+	for _, c := range p {
+		if unicode.IsControl(c) {
+			return false
+		}
+	}
+	return true
 }
 
-func longpollloop() {
+//cachePath is the path part of the cache key of key: lower cased unless
+//-case-sensitive-cache
+func cachePath(key string) string {
+	if caseSensitiveCache {
+		return key
+	}
+	return strings.ToLower(key)
+}
+
+//cacheKey returns the cache key for key (the path being served), including
+//only the query params in cacheKeyParams so tracking params like utm_source
+//don't fragment the cache.
+//
+//Dropbox paths are case insensitive, so the path is lower cased (like Dropbox's
+//PathLower) to keep /File.txt and /file.txt in a single entry, see cachePath.
+func cacheKey(r *http.Request, key string) string {
+	key = cachePath(key)
+	if len(cacheKeyParams) == 0 || r.URL.RawQuery == "" {
+		return key
+	}
+	q := r.URL.Query()
+	keep := url.Values{}
+	for _, p := range cacheKeyParams {
+		if v, ok := q[p]; ok {
+			keep[p] = v
+		}
+	}
+	if len(keep) == 0 {
+		return key
+	}
+	//Encode sorts by key so param order doesn't matter
+	return key + "?" + keep.Encode()
+}
+
+//listFlag is a flag that can be repeated, collecting every value
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listFlag) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+//parseClassBudgets parses "image=100MB,text=50MB" into classBudgets
+func parseClassBudgets(s string) error {
+	for _, part := range strings.Split(s, ",") {
+		if part == "" {
+			continue
+		}
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("invalid class budget %q, expected class=size", part)
+		}
+		n, err := parseSize(kv[1])
+		if err != nil {
+			return fmt.Errorf("invalid class budget %q: %v", part, err)
+		}
+		classBudgets[strings.ToLower(strings.TrimSpace(kv[0]))] = n
+	}
+	return nil
+}
+
+func longpollloop(folder string) {
+	health.watchLongpoll(folder)
+	cur := initialCursor(folder)
+	backoff := longpollBackoffMin
 	for {
-		err := longpoll()
+		start := time.Now()
+		var err error
+		cur, err = safeLongpoll(folder, cur)
+		health.longpollResult(folder, err)
 		if err != nil {
-			log.Println(err)
-			//Backoff a bit
-			time.Sleep(time.Minute)
+			logln(levelError, err)
+			recentErrors.add(err)
+			//Back off exponentially, with jitter so restarted instances don't retry in lockstep
+			if !sleep(backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))) {
+				return
+			}
+			if backoff *= 2; backoff > longpollBackoffMax {
+				backoff = longpollBackoffMax
+			}
+		} else {
+			backoff = longpollBackoffMin
+		}
+		//Hard floor on how often we call Dropbox, whatever longpoll returned
+		if d := longpollMinInterval - time.Since(start); d > 0 && !sleep(d) {
+			return
+		}
+		select {
+		case <-quit:
+			return
+		default:
 		}
 	}
 }
 
-//Longpoll public folder and invalidate all caches if anything changed...
-func longpoll() error {
+//sleep waits for d, returning false early if we are shutting down
+func sleep(d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-quit:
+		return false
+	case <-t.C:
+		return true
+	}
+}
+
+//safeLongpoll turns a panic in longpoll into an error so it goes through the
+//same backoff instead of killing the process
+func safeLongpoll(folder, cur string) (next string, err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			next, err = cur, fmt.Errorf("longpoll panic: %v", p)
+		}
+	}()
+	return longpoll(folder, cur)
+}
+
+//initialCursor acquires the first cursor with a fast bounded backoff, so that a
+//network blip at boot doesn't leave invalidation broken for a whole minute.
+//Returns "" if all retries failed, the steady state loop takes over from there.
+func initialCursor(folder string) string {
+	delay := time.Second
+	for i := 0; i < startupRetries; i++ {
+		cur, err := latestCursor(folder)
+		if err == nil {
+			return cur
+		}
+		logln(levelError, "Initial cursor:", err)
+		if !sleep(delay) {
+			return ""
+		}
+		delay *= 2
+	}
+	return ""
+}
+
+func latestCursor(folder string) (string, error) {
 	lfopt := files.NewListFolderArg(folder)
 	lfopt.Recursive = true
 	cur, err := db.ListFolderGetLatestCursor(lfopt)
 	if err != nil {
-		return err
+		return "", err
+	}
+	atomic.StoreInt32(&ready, 1)
+	return cur.Cursor, nil
+}
+
+//Longpoll a mounted folder and invalidate the changed paths. Returns the cursor
+//to continue from next time.
+//If cur is empty the latest cursor is fetched first.
+func longpoll(folder, cur string) (string, error) {
+	var err error
+	if cur == "" {
+		cur, err = latestCursor(folder)
+		if err != nil {
+			return "", err
+		}
 	}
 	//log.Println(cur)ListFolderLongpollArg
-	dp, err := db.ListFolderLongpoll(&files.ListFolderLongpollArg{Cursor: cur.Cursor, Timeout: 300})
+	dp, err := db.ListFolderLongpoll(&files.ListFolderLongpollArg{Cursor: cur, Timeout: longpollTimeout})
 	if err != nil {
-		return err
+		if e, ok := err.(files.ListFolderLongpollAPIError); ok && e.EndpointError != nil && e.EndpointError.Tag == files.ListFolderLongpollErrorReset {
+			//Not a failure, we just can't tell what changed
+			return cursorReset(folder, "list_folder/longpoll")
+		}
+		return cur, err
+	}
+	if dp.Changes {
+		cur, err = invalidateChanges(folder, cur)
+		if err != nil {
+			return cur, err
+		}
 	}
-	//change <- true
-	log.Println("Invalidating")
-	lmod = time.Now()
 	time.Sleep(time.Second * time.Duration(dp.Backoff))
-	return nil
+	return cur, nil
+}
+
+//invalidateAll is the fallback when we can't tell what changed
+func invalidateAll() {
+	logln(levelInfo, "Invalidating")
+	atomic.StoreInt64(&lmod, time.Now().UnixNano())
+	invalidationLog.record("longpoll", nil)
 }
 
-//dbhandlerNotFound caches 404s so we dont keep spamming dropbox.
-//Pretty cheap
-func dbhandlerNotFound(w http.ResponseWriter, r *http.Request, key string) {
+//cursorReset handles Dropbox resetting the cursor of folder (it does so e.g.
+//after large changes or moves): we can't know what changed, so a fresh cursor
+//is acquired and then everything is invalidated. In that order, so nothing
+//that changes in between is missed. Returns the new cursor.
+func cursorReset(folder, call string) (string, error) {
+	logf(levelWarn, "Dropbox reset the cursor of %q in %s, re-acquiring it and invalidating everything", folder, call)
+	cur, err := latestCursor(folder)
+	invalidateAll()
+	return cur, err
+}
+
+//invalidateChanges walks the entries of folder changed since cur and drops just those
+//from the cache. Returns the new cursor, a fresh one if Dropbox reset the
+//cursor in which case everything is invalidated, see cursorReset.
+func invalidateChanges(folder, cur string) (string, error) {
+	paths := make(map[string]bool)
+	for {
+		res, err := db.ListFolderContinue(files.NewListFolderContinueArg(cur))
+		if err != nil {
+			if e, ok := err.(files.ListFolderContinueAPIError); ok && e.EndpointError != nil && e.EndpointError.Tag == files.ListFolderContinueErrorReset {
+				return cursorReset(folder, "list_folder/continue")
+			}
+			//Cursor is still good, the next longpoll reports the same changes again
+			return cur, err
+		}
+		for _, entry := range res.Entries {
+			var p string
+			switch m := entry.(type) {
+			case *files.FileMetadata:
+				p = m.PathLower
+			case *files.FolderMetadata:
+				p = m.PathLower
+			case *files.DeletedMetadata:
+				p = m.PathLower
+			}
+			for _, key := range urlKeys(folder, p) {
+				paths[key] = true
+				if listing {
+					//Listings live in the entry of the directory's index file
+					paths[strings.TrimSuffix(path.Dir(key), "/")+"/"+strings.ToLower(indexFile)] = true
+				}
+				//The sidecar's Link headers are baked into the page's entry
+				if strings.HasSuffix(key, ".links") {
+					paths[strings.TrimSuffix(key, ".links")] = true
+				}
+				//So are precompressed siblings
+				if precompressed && (strings.HasSuffix(key, ".br") || strings.HasSuffix(key, ".gz")) {
+					paths[key[:len(key)-3]] = true
+				}
+			}
+		}
+		cur = res.Cursor
+		if !res.HasMore {
+			break
+		}
+	}
+	purged := dbcache.purge(paths)
+	if suggest {
+		dirNames.purge(paths)
+	}
+	if bigDir != "" {
+		bigFiles.purge(paths)
+	}
+	logf(levelInfo, "Invalidating %d changed paths, %d cache entries", len(paths), len(purged))
+	if len(purged) > 0 {
+		invalidationLog.record("longpoll", purged)
+	}
+	return cur, nil
+}
+
+//notFound caches 404s so we dont keep spamming dropbox.
+//Pretty cheap. start is when the lookup began, see cache.Set.
+func notFound(r *http.Request, key string, start time.Time) *cacheobj {
 	obj := &cacheobj{
-		lastFetch: time.Now(),
+		lastFetch: start,
 		exists:    false,
 	}
-	dbcache.Set(key, obj)
-	dbhandlerServe(w, r, obj)
+	if suggest {
+		obj.suggestions = suggestFor(key)
+	}
+	if listing && path.Base(key) == indexFile {
+		//No index, keep the directory listing with the 404 instead
+		obj.data = dirListing(strings.TrimSuffix(key, indexFile))
+		obj.listing = obj.data != nil
+	}
+	dbcache.Set(cacheKey(r, key), obj)
+	return obj
+}
+
+//isNotFound reports whether err is GetMetadata's (or ListFolder's)
+//path/not_found. Only that is cached as a 404, anything else (malformed or
+//restricted path, network, 5xx) is an upstream error.
+func isNotFound(err error) bool {
+	switch e := err.(type) {
+	case files.GetMetadataAPIError:
+		return e.EndpointError != nil && e.EndpointError.Tag == files.GetMetadataErrorPath &&
+			e.EndpointError.Path != nil && e.EndpointError.Path.Tag == files.LookupErrorNotFound
+	case files.ListFolderAPIError:
+		return e.EndpointError != nil && e.EndpointError.Tag == files.ListFolderErrorPath &&
+			e.EndpointError.Path != nil && e.EndpointError.Path.Tag == files.LookupErrorNotFound
+	}
+	return false
+}
+
+//unexpectedMetadataError is a GetMetadata answer that is neither a file, a
+//folder nor a deleted entry, which newer API versions could add. It's our
+//bug (500), not Dropbox failing.
+type unexpectedMetadataError struct {
+	key string
+	m   files.IsMetadata
+}
+
+func (e unexpectedMetadataError) Error() string {
+	return fmt.Sprintf("unexpected metadata type %T for %s", e.m, e.key)
+}
+
+//folderFound caches key as a folder, which is served as a redirect to its index.
+//start is when the lookup began.
+func folderFound(r *http.Request, key string, start time.Time) *cacheobj {
+	obj := &cacheobj{
+		lastFetch: start,
+		exists:    false,
+		folder:    true,
+	}
+	dbcache.Set(cacheKey(r, key), obj)
+	return obj
+}
+
+//fetchResult is what a cache fill hands back to every request waiting on it
+type fetchResult struct {
+	obj    *cacheobj
+	stream bool //Too big to cache, each request streams it from Dropbox
+	stale  bool //obj is the old object, kept because Dropbox rejected the credentials
+	head   bool //Only the metadata was looked up, obj has no body and isn't cached
 }
 
+//dbhandlerMiss fills the cache for key and serves it. Concurrent misses for
+//the same key share one fetch.
 func dbhandlerMiss(w http.ResponseWriter, r *http.Request, key string, oldobj *cacheobj) {
+	if rateMissesOnly && rateLimited(w, r) {
+		return
+	}
+	//A HEAD miss is answered from the metadata alone, without downloading (or
+	//caching) the body. Rewritten pages change length, those need the body to
+	//get Content-Length right.
+	head := r.Method == http.MethodHead && (rewriteBase == "" || !strings.HasPrefix(contentTypeFor(key), "text/html"))
+	ck := cacheKey(r, key)
+	if head {
+		//A GET joining the fill would get no body
+		ck = "HEAD " + ck
+	}
+	res, err := fills.do(r, ck, func(ctx context.Context) (fetchResult, error) {
+		return fetch(ctx, r, key, oldobj, head)
+	})
+	if err != nil {
+		upstreamError(w, r, err)
+		return
+	}
+	switch {
+	case res.stream, res.head:
+		dbhandlerStream(w, r, key, res.obj)
+	case res.stale:
+		atomic.AddInt64(&staleServed, 1)
+		w.Header().Set("Warning", `110 - "Response is Stale"`)
+		dbhandlerServe(w, r, res.obj)
+	default:
+		dbhandlerServe(w, r, res.obj)
+	}
+}
+
+//notFoundDocument returns the cached (or freshly fetched) -404-page object, nil
+//if there is none or r is for the 404 page itself
+func notFoundDocument(r *http.Request) *cacheobj {
+	if notFoundPage == "" || wantsJSON(r) || strings.EqualFold(r.URL.Path, notFoundPage) {
+		return nil
+	}
+	return document(r, notFoundPage)
+}
+
+//spaRoute reports whether a 404 for r should be the -spa-fallback instead: a GET
+//by a browser for a path without an extension. Missing assets still 404.
+func spaRoute(r *http.Request) bool {
+	return spaFallback != "" && r.Method == http.MethodGet && path.Ext(r.URL.Path) == "" &&
+		strings.Contains(r.Header.Get("Accept"), "text/html") && !strings.EqualFold(r.URL.Path, spaFallback)
+}
+
+//document returns the cached (or freshly fetched) object of the page p served in
+//place of another path, nil if it doesn't exist or is too big to cache
+func document(r *http.Request, p string) *cacheobj {
+	obj, err := dbcache.Get(cacheKey(r, p))
+	if err != nil || obj.stale() {
+		var res fetchResult
+		res, err = fills.do(r, cacheKey(r, p), func(ctx context.Context) (fetchResult, error) {
+			return fetch(ctx, r, p, obj, false)
+		})
+		if err != nil {
+			logRequest(r, p+":", err)
+			return nil
+		}
+		if res.stream {
+			//Too big to cache, not worth streaming in place of other paths
+			return nil
+		}
+		obj = res.obj
+	}
+	if !obj.exists {
+		return nil
+	}
+	return obj
+}
+
+//fetch gets key from Dropbox and caches it. It gives up on the download when ctx
+//is canceled, the SDK can't cancel the calls themselves. With head it stops
+//after the metadata when a download would be needed.
+func fetch(ctx context.Context, r *http.Request, key string, oldobj *cacheobj, head bool) (fetchResult, error) {
+	release, err := acquireUpstream(ctx)
+	if err != nil {
+		return fetchResult{}, err
+	}
+	defer release()
+	if oldobj != nil {
+		if trigger := oldobj.expired(); trigger != "" {
+			invalidationLog.record(trigger, []string{cacheKey(r, key)})
+		}
+	}
 	//Fetch from dropbox, make obj
-	tmp, err := db.GetMetadata(files.NewGetMetadataArg(folder + key))
+	start := time.Now()
+	var tmp files.IsMetadata
+	err = retryRateLimited(func() (err error) {
+		tmp, err = db.GetMetadata(files.NewGetMetadataArg(dropboxPath(key)))
+		return err
+	})
+	track(r, "metadata", start)
+	dropboxStats.observe("get_metadata", start, err)
+	if _, authErr := err.(auth.AuthAPIError); authErr {
+		health.setAuthFailure(err)
+		if serveStaleOnAuthFailure && oldobj != nil {
+			//Availability over freshness: keep serving what we have
+			logRequest(r, "Serving stale", key, "after auth failure:", err)
+			return fetchResult{obj: oldobj, stale: true}, nil
+		}
+	} else if err == nil {
+		health.setAuthFailure(nil)
+	}
 	if err != nil {
-		log.Println(err)
-		httperr, ok := err.(files.GetMetadataAPIError)
-		if ok && strings.Contains(httperr.APIError.Error(), "not_found") {
-			//Create 404 obj and serve.
-			dbhandlerNotFound(w, r, key)
-			return
+		if isNotFound(err) {
+			//An answer, not a failure. Create 404 obj and serve. Suggestions and
+			//listings take slots of their own.
+			logRequestAt(levelDebug, r, err)
+			release()
+			return fetchResult{obj: notFound(r, key, start)}, nil
 		}
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		logRequest(r, err)
+		recentErrors.add(err)
+		return fetchResult{}, err
 	}
-	entry, ok := tmp.(*files.FileMetadata)
-	if !ok {
-		dbhandlerNotFound(w, r, key)
+	var entry *files.FileMetadata
+	switch m := tmp.(type) {
+	case *files.FileMetadata:
+		entry = m
+	case *files.FolderMetadata:
+		return fetchResult{obj: folderFound(r, key, start)}, nil
+	case *files.DeletedMetadata:
+		//Only returned with include_deleted, but it is gone either way
+		release()
+		return fetchResult{obj: notFound(r, key, start)}, nil
+	default:
+		//Not cached, the next request asks again
+		err := unexpectedMetadataError{key, tmp}
+		logRequest(r, err)
+		return fetchResult{}, err
 	}
 	//We have entry, and no errors... so far...
 	obj := &cacheobj{
-		lastFetch: time.Now(),
-		exists:    true,
-		entry:     entry,
+		lastFetch:   start, //Not now: a change during the fetch must still invalidate it
+		exists:      true,
+		entry:       entry,
+		contentType: contentTypeFor(key),
+	}
+	if obj.entry.Size > uint64(maxCacheSize) || (maxFileSize > 0 && obj.entry.Size > uint64(maxFileSize)) {
+		//Too big to cache, copy it straight through (dbhandlerStream refuses what is over -max-file-size)
+		return fetchResult{obj: obj, stream: true}, nil
 	}
 	//If oldobj is still valid, reuse it instead of fetch again...
 	if oldobj != nil {
 		//oldobj was not 404
 		if oldobj.entry != nil {
-			//oldobj is same version as obj
-			if oldobj.entry.Rev == obj.entry.Rev {
+			//oldobj is the same version as obj, or has the same content under a new rev
+			//(some sync clients re-save files unchanged)
+			sameContent := obj.entry.ContentHash != "" && oldobj.entry.ContentHash == obj.entry.ContentHash
+			if oldobj.entry.Rev == obj.entry.Rev || sameContent {
 				obj.data = oldobj.data
-				obj.contentType = oldobj.contentType
+				obj.hash = oldobj.hash
+				sniffContentType(obj, key)
+				//The sidecar may have changed even if the page did not
+				obj.links = fetchLinks(key, obj.contentType)
+				//The compressed copies did not, a changed sibling purges the original
+				reuseEncodings(obj, oldobj)
+				if precompressed && compressible(obj.contentType) && negativeTTL > 0 && time.Since(obj.siblingsAt) > negativeTTL {
+					//Missing siblings are re-checked like cached 404s
+					loadPrecompressed(ctx, r, obj, key)
+				}
 				//obj.entry.MimeType = oldobj.entry.MimeType
-				dbcache.Set(key, obj)
-				dbhandlerServe(w, r, obj)
-				return
+				dbcache.Set(cacheKey(r, key), obj)
+				return fetchResult{obj: obj}, nil
+			}
+		}
+	}
+	if head {
+		//dbhandlerStream knows to stop after the headers
+		return fetchResult{obj: obj, head: true}, nil
+	}
+	if obj.entry.Size == 0 {
+		//Nothing to download. data must be non nil, an empty file is not a 404.
+		obj.data = []byte{}
+	} else {
+		if ctx.Err() != nil {
+			//Nobody wants it anymore
+			return fetchResult{}, ctx.Err()
+		}
+		var rd io.ReadCloser
+		start = time.Now()
+		err = retryRateLimited(func() (err error) {
+			obj.entry, rd, err = db.Download(files.NewDownloadArg(dropboxPath(key)))
+			return err
+		})
+		dropboxStats.observe("download", start, err)
+		if err != nil {
+			recentErrors.add(err)
+			return fetchResult{}, err
+		}
+		defer rd.Close()
+		stop := closeOnDone(ctx, rd)
+		defer stop()
+		var body io.Reader = rd
+		h := sha512.New384()
+		if hashContent {
+			//Hash while reading instead of another pass over the data
+			body = io.TeeReader(rd, h)
+		}
+		obj.data, err = ioutil.ReadAll(body)
+		track(r, "download", start)
+		if ctx.Err() != nil {
+			return fetchResult{}, ctx.Err()
+		}
+		if err != nil {
+			return fetchResult{}, err
+		}
+		if hashContent {
+			obj.hash = h.Sum(nil)
+		}
+	}
+	sniffContentType(obj, key)
+	rewritten := rewriteBaseHref(obj.data, obj.contentType)
+	if hashContent && (obj.hash == nil || !bytes.Equal(rewritten, obj.data)) {
+		//The hash must be of what we serve
+		sum := sha512.Sum384(rewritten)
+		obj.hash = sum[:]
+	}
+	if precompressed && compressible(obj.contentType) && bytes.Equal(rewritten, obj.data) {
+		//Siblings of a page whose <base> we rewrite would be of the original
+		loadPrecompressed(ctx, r, obj, key)
+	}
+	obj.data = rewritten
+	obj.links = fetchLinks(key, obj.contentType)
+	dbcache.Set(cacheKey(r, key), obj)
+	return fetchResult{obj: obj}, nil
+}
+
+//contentTypeFor is the Content-Type of key, from the extension of its last path
+//element: -mime and the built in mimeTypes, then the OS mime database, and
+//-default-content-type if neither knows it
+func contentTypeFor(key string) string {
+	if mtype := typeByExtension(key); mtype != "" {
+		return mtype
+	}
+	return defaultContentType
+}
+
+//typeByExtension is contentTypeFor without the default, "" for an unknown or
+//missing extension
+func typeByExtension(key string) string {
+	//Dropbox doesn't tell us a usable type (it does not have the correct one for json!)
+	ext := path.Ext(key)
+	if ext == "" {
+		return ""
+	}
+	if mtype, ok := mimeTypes[strings.ToLower(ext)]; ok {
+		return mtype
+	}
+	return mime.TypeByExtension(ext)
+}
+
+//dbhandlerStream serves objects larger than maxCacheSize without buffering or caching them
+func dbhandlerStream(w http.ResponseWriter, r *http.Request, key string, obj *cacheobj) {
+	for _, v := range extraVary {
+		w.Header().Add("Vary", v)
+	}
+	if dbhandlerHeaders(w, r, obj, "") {
+		return
+	}
+	size := int64(obj.entry.Size)
+	tooBig := maxFileSize > 0 && size > maxFileSize
+	if tempLinkAbove > 0 && (size > tempLinkAbove || tooBig) && r.Method == http.MethodGet {
+		//Let Dropbox serve the bytes, proxying them is the fallback
+		link, err := temporaryLink(r.Context(), key, obj.entry.Rev)
+		if err == nil {
+			for _, h := range []string{"Content-Type", "ETag", "Last-Modified", "Accept-Ranges", "X-Integrity", surrogateHeader} {
+				w.Header().Del(h)
 			}
+			//The link expires, nobody may keep the redirect
+			w.Header().Set("Cache-Control", "no-store")
+			writeTimings(w, r)
+			http.Redirect(w, r, link, http.StatusFound)
+			return
 		}
+		logRequest(r, "Temporary link for", key, "failed, proxying:", err)
 	}
+	if tooBig {
+		for _, h := range []string{"Content-Type", "ETag", "Last-Modified", "Accept-Ranges", "X-Integrity", "Cache-Control", surrogateHeader} {
+			w.Header().Del(h)
+		}
+		httpError(w, r, "File too large to serve", http.StatusRequestEntityTooLarge)
+		return
+	}
+	toDisk := bigDir != "" && size <= bigMaxSize && r.Method == http.MethodGet
+	if toDisk {
+		if f := bigFiles.open(cachePath(key), obj.entry.Rev); f != nil {
+			defer f.Close()
+			setCacheStatus(r, "disk")
+			writeTimings(w, r)
+			//Ranges and preconditions are taken care of like for cached files
+			http.ServeContent(w, r, "", obj.entry.ServerModified, f)
+			return
+		}
+	}
+	arg := files.NewDownloadArg(dropboxPath(key))
+	status := http.StatusOK
+	if rh := r.Header.Get("Range"); rh != "" && ifRangeMatches(r, obj) {
+		br, ok, unsatisfiable := parseSingleRange(rh, size)
+		if unsatisfiable {
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+			httpError(w, r, "Requested range not satisfiable", http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		if ok {
+			//Let Dropbox send us only the part we need
+			arg.ExtraHeaders = map[string]string{"Range": fmt.Sprintf("bytes=%d-%d", br.start, br.end)}
+			w.Header().Set("Content-Range", br.contentRange(size))
+			w.Header().Set("Content-Length", strconv.FormatInt(br.end-br.start+1, 10))
+			status = http.StatusPartialContent
+		}
+	}
+	if status == http.StatusOK {
+		//Lets clients show progress, gziphandler drops it again if it compresses
+		w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	}
+	if r.Method == http.MethodHead {
+		writeTimings(w, r)
+		w.WriteHeader(status)
+		return
+	}
+	start := time.Now()
 	var rd io.ReadCloser
-	obj.entry, rd, err = db.Download(files.NewDownloadArg(folder + key))
+	release, err := acquireUpstream(r.Context())
+	if err == nil {
+		err = retryRateLimited(func() (err error) {
+			_, rd, err = db.Download(arg)
+			return err
+		})
+		//The slot bounds opening downloads, a slow client must not hold it
+		release()
+	}
+	track(r, "download", start)
+	dropboxStats.observe("download", start, err)
+	writeTimings(w, r)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		w.Header().Del("Content-Range")
+		w.Header().Del("Content-Length")
+		w.Header().Del("Cache-Control")
+		w.Header().Del(surrogateHeader)
+		recentErrors.add(err)
+		upstreamError(w, r, err)
 		return
 	}
 	defer rd.Close()
-	//TODO: if the file is larger than maxCacheSize, then bypass cache and copy reader to writer
-	obj.data, err = ioutil.ReadAll(rd)
+	//Stop reading from Dropbox as soon as the client is gone, even if upstream is stalled
+	stop := closeOnDone(r.Context(), rd)
+	defer stop()
+	w.WriteHeader(status)
+	var dst io.Writer = w
+	commit := func(int64) {}
+	if toDisk && status == http.StatusOK {
+		//Keep the whole body for the next request
+		var tw io.Writer
+		tw, commit = bigFiles.tee(cachePath(key), obj.entry.Rev, size)
+		dst = io.MultiWriter(w, tw)
+	}
+	n, err := io.Copy(dst, rd)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		//Headers are gone already, all we can do is log
+		logRequest(r, "Streaming", key, err)
+		n = -1
+	}
+	commit(n)
+}
+
+//etag is the ETag of rev served with the content coding enc, "" for identity.
+//Each coding is its own representation with its own strong ETag (RFC 9110
+//8.8.3), a cache must not answer a Range of the identity body from a gzip one.
+func etag(rev, enc string) string {
+	if enc == "" {
+		return `"` + rev + `"`
+	}
+	return `"` + rev + "-" + enc + `"`
+}
+
+//tagRev is the rev of an ETag from a request, without quotes and coding
+//suffix. Revs are hex, they never contain a "-".
+func tagRev(tag string) string {
+	tag = strings.Trim(tag, `"`)
+	for _, enc := range []string{"-br", "-gzip"} {
+		tag = strings.TrimSuffix(tag, enc)
 	}
-	//Fix mime type - for when dropbox does not detect
-	//Dropbox does not have correct mime for json!
-	obj.contentType = "application/octet-stream"
-	s := strings.Split(key, ".")
-	if len(s) > 1 {
-		ext := "." + s[len(s)-1]
-		mtype := mime.TypeByExtension(ext)
-		if mtype != "" {
-			obj.contentType = mtype
+	return tag
+}
+
+//etagStrongMatch reports whether an If-Match style list matches rev. Accepts
+//bare values too, we used to emit the rev unquoted; weak etags never match.
+func etagStrongMatch(header, rev string) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" {
+			return true
+		}
+		if strings.HasPrefix(tag, "W/") {
+			continue
+		}
+		if tagRev(tag) == rev {
+			return true
 		}
 	}
-	dbcache.Set(key, obj)
-	dbhandlerServe(w, r, obj)
+	return false
+}
+
+//etagWeakMatch reports whether an If-None-Match list matches rev, comparing
+//weakly (W/ is ignored). * matches any existing object.
+func etagWeakMatch(header, rev string) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" {
+			return true
+		}
+		if tagRev(strings.TrimPrefix(tag, "W/")) == rev {
+			return true
+		}
+	}
+	return false
+}
+
+//fetchLinks reads the <key>.links sidecar for html pages. Each non empty line is
+//a Link header value, e.g. </app.css>; rel=preload; as=style
+func fetchLinks(key, contentType string) []string {
+	if !preloadLinks || !strings.HasPrefix(contentType, "text/html") {
+		return nil
+	}
+	_, rd, err := db.Download(files.NewDownloadArg(dropboxPath(key + ".links")))
+	if err != nil {
+		//Missing sidecar is the common case, so not worth logging.
+		return nil
+	}
+	defer rd.Close()
+	data, err := ioutil.ReadAll(rd)
+	if err != nil {
+		logln(levelError, err)
+		return nil
+	}
+	var links []string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "#") {
+			links = append(links, line)
+		}
+	}
+	return links
 }
 
 //Serve object from cache
 func dbhandlerServe(w http.ResponseWriter, r *http.Request, obj *cacheobj) {
+	writeTimings(w, r)
+	for _, v := range extraVary {
+		w.Header().Add("Vary", v)
+	}
+	if obj.folder && !strings.HasSuffix(r.URL.Path, "/") {
+		//Like net/http's FileServer, so relative links in the index resolve
+		redirectPath(w, r, r.URL.Path+"/", http.StatusMovedPermanently)
+		return
+	}
+	if obj.listing && strings.HasSuffix(r.URL.Path, "/") {
+		serveListing(w, r, obj)
+		return
+	}
+	if !obj.exists && spaRoute(r) {
+		//A client side route of the app, its entrypoint takes over. The same
+		//URL is a 404 for clients not asking for html.
+		varyAccept(w)
+		if page := document(r, spaFallback); page != nil {
+			dbhandlerServe(w, r, page)
+			return
+		}
+	}
+	if !obj.exists && r.URL.Path == "/favicon.ico" {
+		//No icon. An empty answer instead of a 404 page browsers never show.
+		setCacheControl(w, false, protected(r.URL.Path))
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
 	if !obj.exists {
-		http.Error(w, "File not found", http.StatusNotFound)
+		//Shorter, so intermediaries notice a newly uploaded file soon
+		setCacheControl(w, false, protected(r.URL.Path))
+		//The -404-page for browsers, otherwise JSON or text as negotiated by writeError
+		varyAccept(w)
+		if page := notFoundDocument(r); page != nil {
+			w.Header().Set("Content-Type", page.contentType)
+			w.Header().Set("Content-Length", strconv.Itoa(len(page.data)))
+			w.WriteHeader(http.StatusNotFound)
+			w.Write(page.data)
+			return
+		}
+		writeError(w, r, errorBody{Error: "File not found", Status: http.StatusNotFound, Suggestions: obj.suggestions})
+		return
+	}
+	enc := ""
+	if r.Header.Get("Range") == "" && len(obj.data) >= minCompressSize && compressible(obj.contentType) {
+		//Vary: Accept-Encoding is added by gziphandler
+		enc = negotiateEncoding(r, "br", "gzip")
+	}
+	if dbhandlerHeaders(w, r, obj, enc) {
 		return
 	}
+	body := obj.data
+	if enc != "" {
+		//Compressed once per object, gziphandler leaves it alone since the encoding is set
+		body = obj.encoded(enc)
+		w.Header().Set("Content-Encoding", enc)
+	}
+	//ServeContent takes care of Range requests, including multiple ranges as multipart/byteranges
+	http.ServeContent(w, r, "", obj.entry.ServerModified, bytes.NewReader(body))
+}
+
+//setCacheControl sets the -cache-control (for browsers) and -surrogate-control
+//(for CDNs) headers of a response for a found file, or their -404 variants.
+//Responses that needed credentials are private instead, a shared cache must
+//not hand them to anyone else.
+func setCacheControl(w http.ResponseWriter, found, private bool) {
+	if private {
+		w.Header().Set("Cache-Control", "private, no-cache")
+		w.Header().Del(surrogateHeader)
+		w.Header().Add("Vary", "Authorization")
+		return
+	}
+	if cacheControl != "" {
+		if found {
+			w.Header().Set("Cache-Control", cacheControl)
+		} else {
+			w.Header().Set("Cache-Control", notFoundCacheControl)
+		}
+	}
+	if surrogateControl != "" {
+		if found {
+			w.Header().Set(surrogateHeader, surrogateControl)
+		} else if notFoundSurrogateControl != "" {
+			w.Header().Set(surrogateHeader, notFoundSurrogateControl)
+		}
+	}
+}
+
+//dbhandlerHeaders sets the response headers for an existing obj served with
+//content coding enc ("" for identity) and evaluates conditional request
+//headers. Returns true if the response is complete (304/412). Validators match
+//whatever coding of the rev the client has.
+func dbhandlerHeaders(w http.ResponseWriter, r *http.Request, obj *cacheobj, enc string) bool {
 	w.Header().Set("Content-Type", obj.contentType)
-	w.Header().Set("etag", obj.entry.Rev)
+	w.Header().Set("ETag", etag(obj.entry.Rev, enc)) //Quoted, RFC 7232
 	mtime := obj.entry.ServerModified
-	w.Header().Set("last-modified", mtime.Format(http.TimeFormat))
+	w.Header().Set("Last-Modified", mtime.Format(http.TimeFormat))
+	w.Header().Set("Accept-Ranges", "bytes")
+	setCacheControl(w, true, protected(r.URL.Path))
+	if sriHeader && obj.hash != nil {
+		w.Header().Set("X-Integrity", obj.sri())
+	}
+	for _, l := range obj.links {
+		w.Header().Add("Link", l)
+	}
+	//Preconditions (RFC 7232). Streamed objects don't go through ServeContent,
+	//so we evaluate them for both and drop the headers.
+	if im := r.Header.Get("If-Match"); im != "" {
+		if !etagStrongMatch(im, obj.entry.Rev) {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return true
+		}
+	} else if ius, err := http.ParseTime(r.Header.Get("If-Unmodified-Since")); err == nil {
+		if mtime.Truncate(time.Second).After(ius) {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return true
+		}
+	}
+	r.Header.Del("If-Match")
+	r.Header.Del("If-Unmodified-Since")
 	//See conditional request headers and 304 if needed
-	if r.Header.Get("If-None-Match") == obj.entry.Rev {
-		//Our cached version matches the one user has cached.
-		w.WriteHeader(http.StatusNotModified)
-		return
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		if etagWeakMatch(inm, obj.entry.Rev) {
+			//Our cached version matches the one user has cached.
+			if r.Method == http.MethodGet || r.Method == http.MethodHead {
+				w.WriteHeader(http.StatusNotModified)
+			} else {
+				w.WriteHeader(http.StatusPreconditionFailed)
+			}
+			return true
+		}
+		//If-Modified-Since is ignored when If-None-Match is present (RFC 7232 3.3)
+		return false
+	}
+	if ims, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil && (r.Method == http.MethodGet || r.Method == http.MethodHead) {
+		//Last-Modified has second precision
+		if !mtime.Truncate(time.Second).After(ims) {
+			w.WriteHeader(http.StatusNotModified)
+			return true
+		}
 	}
-	//TODO: How to manage cache-controls.... should we do it?
-	w.Write(obj.data)
+	return false
 }
 
 func dbhandler(w http.ResponseWriter, r *http.Request) {
 	key := r.URL.Path
-	//Add a robots.txt . We dont want google to index
-	if r.URL.Path == "/robots.txt" {
+	if cors(w, r) {
+		return
+	}
+	if r.Method == http.MethodOptions {
+		//Nothing to look up, just advertise what we support. OPTIONS * gets
+		//here too, newServer turns off net/http's own answer.
+		w.Header().Set("Allow", "GET, HEAD, OPTIONS")
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead && !(adminToken != "" && strings.HasPrefix(key, "/admin/")) {
+		//Everything but the admin endpoints is read only
+		w.Header().Set("Allow", "GET, HEAD, OPTIONS")
+		httpError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !validPath(key) {
+		httpError(w, r, "Invalid path", http.StatusBadRequest)
+		return
+	}
+	if clean := cleanPath(key); clean != key {
+		//Redirect so clients and caches converge on one URL per object
+		redirectPath(w, r, clean, http.StatusMovedPermanently)
+		return
+	}
+	if len(dropboxPath(key)) > maxPathLength {
+		//Dropbox would reject it anyway, don't waste an API call
+		httpError(w, r, "URI too long", http.StatusRequestURITooLong)
+		return
+	}
+	if denied(w, r, key) {
+		return
+	}
+	//Add a robots.txt . By default we dont want google to index
+	if r.URL.Path == "/robots.txt" && robots != "file" {
+		if robots == "allow" {
+			w.Write([]byte("User-agent: *\nDisallow:\n"))
+			return
+		}
 		w.Write([]byte(`User-agent: *
 Disallow: /
 `))
 		return
-	} else if r.URL.Path == "/" {
-		//Redirect root page to git repo . Shameless plug :)
-		http.Redirect(w, r, "https://github.com/sajal/dboxserver", http.StatusFound)
+	} else if r.URL.Path == "/favicon.ico" && favicon == "none" {
+		//Browsers ask for it on every site, don't spend an API call on it
+		w.WriteHeader(http.StatusNoContent)
+		return
+	} else if r.URL.Path == "/readyz" {
+		if atomic.LoadInt32(&ready) == 0 {
+			httpError(w, r, "not yet initialized", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok\n"))
+		return
+	} else if wellKnownDir != "" && strings.HasPrefix(r.URL.Path, "/.well-known/") {
+		//Challenge files written locally by external cert tooling
+		http.StripPrefix("/.well-known/", http.FileServer(http.Dir(wellKnownDir))).ServeHTTP(w, r)
+		return
+	} else if adminToken != "" && strings.HasPrefix(r.URL.Path, "/admin/") {
+		adminHandler(w, r)
+		return
+	} else if metricsPage && r.URL.Path == "/metrics" {
+		metricsHandler(w, r)
+		return
+	} else if statusPage && r.URL.Path == "/status" {
+		statusHandler(w, r)
+		return
+	} else if versionPage && r.URL.Path == "/version" {
+		versionHandler(w, r)
+		return
+	} else if r.URL.Path == "/healthz" {
+		healthHandler(w, r)
+		return
+	} else if r.URL.Path == "/" && rootRedirect != "" {
+		//Otherwise / is a directory like any other and serves its index
+		http.Redirect(w, r, rootRedirect, http.StatusFound)
+		return
+	}
+	if !rateMissesOnly && rateLimited(w, r) {
+		return
+	}
+	if dropboxPath(key) == "" {
+		//Not under any -mount
+		httpError(w, r, "File not found", http.StatusNotFound)
+		return
+	}
+	if !authorize(w, r, key) {
+		return
+	}
+	if canonicalIndex && path.Base(key) == indexFile {
+		//Canonicalize /dir/index.html to /dir/ which serves the same object
+		redirectPath(w, r, strings.TrimSuffix(r.URL.Path, indexFile), http.StatusMovedPermanently)
+		return
+	}
+	if dl := r.URL.Query().Get("download"); archives && dl != "" && strings.HasSuffix(key, "/") {
+		dbhandlerArchive(w, r, key, dl)
+		return
+	}
+	if r.URL.Path == "/favicon.ico" && favicon != "" {
+		//-favicon, the icon lives elsewhere in the folder
+		key = favicon
+	}
+	if strings.HasSuffix(key, "/") {
+		//Directory, serve its index file
+		key += indexFile
+	}
+	r = withTimings(r)
+	if t := r.URL.Query().Get("thumb"); thumbnails && t != "" && thumbnailable(key) {
+		dbhandlerThumb(w, r, key, t)
 		return
 	}
-	//TODO: Do we need to validate anything in the path?
-	obj, err := dbcache.Get(key)
+	start := time.Now()
+	obj, err := dbcache.Get(cacheKey(r, key))
+	track(r, "cache", start)
+	if err == nil && !obj.stale() && forceRefresh(r, obj) {
+		//The client wants a fresh copy, check the rev with Dropbox
+		atomic.AddInt64(&cacheMisses, 1)
+		setCacheStatus(r, "refresh")
+		dbhandlerMiss(w, r, key, obj)
+		return
+	}
+	if err == nil && !obj.stale() {
+		atomic.AddInt64(&cacheHits, 1)
+		if !obj.exists {
+			atomic.AddInt64(&negativeHits, 1)
+			setCacheStatus(r, "404")
+		} else {
+			setCacheStatus(r, "hit")
+		}
+	} else {
+		atomic.AddInt64(&cacheMisses, 1)
+		setCacheStatus(r, "miss")
+	}
 	if err == errNotCached {
 		//goto cache miss
 		dbhandlerMiss(w, r, key, nil)
@@ -216,11 +1422,34 @@ Disallow: /
 	}
 	if err != nil {
 		//Return fail...
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		httpError(w, r, err.Error(), http.StatusInternalServerError)
 		return
 	}
 	//Check lastfetched
-	if obj.lastFetch.Before(lmod) {
+	if obj.stale() {
+		ck := cacheKey(r, key)
+		if staleWhileRevalidate && obj.exists && obj.staleFor() < staleWindow {
+			//Serve what we have now, the next request gets the new version. Not
+			//for longer than staleWindow, if revalidating keeps failing clients
+			//must see the errors rather than an old version forever.
+			if refreshes.start(ck) {
+				go revalidate(r.Clone(detachedContext(r)), key, obj)
+			}
+			setCacheStatus(r, "stale")
+			dbhandlerServe(w, r, obj)
+			return
+		}
+		if !refreshes.start(ck) {
+			if obj.exists && obj.staleFor() < staleWindow {
+				//Someone is already re-fetching it, serve what we have meanwhile
+				//instead of piling more requests onto Dropbox.
+				dbhandlerServe(w, r, obj)
+				return
+			}
+			dbhandlerMiss(w, r, key, obj)
+			return
+		}
+		defer refreshes.done(ck)
 		//goto cache miss
 		dbhandlerMiss(w, r, key, obj)
 		return
@@ -229,43 +1458,548 @@ Disallow: /
 	dbhandlerServe(w, r, obj)
 }
 
+//revalidate re-fetches the stale obj of key in the background, for
+//-stale-while-revalidate. br is a clone of the request made before it is served
+//(which changes its headers), with a detachedContext since it is done by then.
+func revalidate(br *http.Request, key string, obj *cacheobj) {
+	ck := cacheKey(br, key)
+	defer refreshes.done(ck)
+	_, err := fills.do(br, ck, func(ctx context.Context) (fetchResult, error) {
+		return fetch(ctx, br, key, obj, false)
+	})
+	if err != nil {
+		logRequest(br, "Revalidating", key, "failed:", err)
+	}
+}
+
+//compressHandler gzips responses, except Range requests: compressing a 206
+//would make Content-Range refer to bytes of the wrong representation.
+func compressHandler(h http.Handler) http.Handler {
+	wrap, err := gziphandler.GzipHandlerWithOpts(gziphandler.ContentTypes(compressibleTypes), gziphandler.CompressionLevel(gzipLevel))
+	if err != nil {
+		log.Fatal(err)
+	}
+	gz := wrap(h)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Range") != "" {
+			//Same URL may be gzipped for other requests
+			w.Header().Add("Vary", "Accept-Encoding")
+			h.ServeHTTP(w, r)
+			return
+		}
+		gz.ServeHTTP(w, r)
+	})
+}
+
+//newHandler is the complete handler the servers use: dbhandler under
+//-base-path, compressed, with the security headers, access logged and tagged
+//with a request id. Everything it serves from is package state set up by
+//main: db, dbcache, mounts, lmod and the flags. There is no Server struct
+//holding them yet, so one process serves one configuration and tests swapping
+//that state (see testHandler) can't run in parallel.
+func newHandler() http.Handler {
+	return withRequestID(logAccess(securityHeaders(compressHandler(stripBase(limitInflight(http.HandlerFunc(dbhandler)))))))
+}
+
+//redirectPath redirects to path p of this server, under -base-path, keeping the query
+func redirectPath(w http.ResponseWriter, r *http.Request, p string, code int) {
+	u := *r.URL
+	u.Path = basePath + p
+	u.RawPath = ""
+	http.Redirect(w, r, u.String(), code)
+}
+
+//stripBase serves requests under -base-path with the prefix removed from the
+//path, anything outside it is a 404
+func stripBase(h http.Handler) http.Handler {
+	if basePath == "" {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "*" {
+			//OPTIONS * is about the server, not a path under the prefix
+			h.ServeHTTP(w, r)
+			return
+		}
+		if r.URL.Path != basePath && !strings.HasPrefix(r.URL.Path, basePath+"/") {
+			httpError(w, r, "File not found", http.StatusNotFound)
+			return
+		}
+		r2 := new(http.Request)
+		*r2 = *r
+		r2.URL = new(url.URL)
+		*r2.URL = *r.URL
+		r2.URL.Path = strings.TrimPrefix(r.URL.Path, basePath)
+		r2.URL.RawPath = ""
+		h.ServeHTTP(w, r2)
+	})
+}
+
+//redirectHTTPS permanently redirects to the https version of the URL, keeping path and query
+func redirectHTTPS(w http.ResponseWriter, r *http.Request) {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+}
+
+//httpsOnly redirects requests that didn't come over https to redirectHTTPS, so a
+//TLS terminating proxy forwarding https as plain http doesn't loop
+func httpsOnly(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isHTTPS(r) && r.URL.Path != "*" {
+			redirectHTTPS(w, r)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+//tlsConfig returns the TLS settings. Session tickets let returning clients
+//resume without a full handshake; the ticket keys are rotated by crypto/tls.
+func tlsConfig(getCert func(*tls.ClientHelloInfo) (*tls.Certificate, error)) *tls.Config {
+	return &tls.Config{
+		GetCertificate:         getCert,
+		MinVersion:             tlsMinVersion,
+		SessionTicketsDisabled: !tlsSessionTickets,
+	}
+}
+
+//newServer is an http server for h on addr with the -read-header-timeout etc.
+//and -keep-alives settings, every listener gets the same
+func newServer(addr string, h http.Handler) *http.Server {
+	s := &http.Server{
+		Addr:              addr,
+		Handler:           h,
+		ReadHeaderTimeout: readHeaderTimeout,
+		ReadTimeout:       readTimeout,
+		WriteTimeout:      writeTimeout,
+		IdleTimeout:       idleTimeout,
+		MaxHeaderBytes:    1 << 20,
+		//Our OPTIONS * has the Allow header, net/http's doesn't
+		DisableGeneralOptionsHandler: true,
+	}
+	s.SetKeepAlivesEnabled(keepAlives)
+	return s
+}
+
 func main() {
-	hostname := flag.String("hostname", "", "if present it will serve on https using autocert")
+	var hostnames listFlag
+	flag.BoolVar(&forceHTTPS, "force-https", false, "Redirect requests on -addr to https unless a -trusted-proxy says they came over https (X-Forwarded-Proto)")
+	flag.Var(&hostnames, "hostname", "if present it will serve on https using autocert. Repeatable or comma separated for several hostnames")
+	acmeCache := flag.String("acme-cache", "", "Directory to keep Let's Encrypt certificates in across restarts")
 	flag.StringVar(&folder, "folder", "/Public", "The dropbox folder to serve from")
+	flag.StringVar(&asMember, "as-member", os.Getenv("DROPBOX_MEMBER_ID"), "Team member id (dbmid:...) to act as with a Dropbox Business team app, default $DROPBOX_MEMBER_ID")
+	flag.StringVar(&pathRoot, "path-root", os.Getenv("DROPBOX_PATH_ROOT"), "Resolve paths against home, root:<namespace id> (the team space) or namespace:<namespace id> (a team folder), default $DROPBOX_PATH_ROOT")
+	flag.BoolVar(&staleWhileRevalidate, "stale-while-revalidate", false, "After an invalidation, keep serving the cached version of a file while it is re-fetched in the background, for at most -stale-window")
+	flag.DurationVar(&staleWindow, "stale-window", 10*time.Second, "After an invalidation, serve the old version to other requests while one re-fetches it, for at most this long. 0 disables")
+	flag.IntVar(&maxPathLength, "max-path-length", 1024, "Requests whose Dropbox path would be longer than this get 414")
+	flag.StringVar(&adminToken, "admin-token", "", "Shared secret enabling the /admin/ endpoints, sent as X-Admin-Token or a bearer token")
+	flag.StringVar(&rewriteBase, "rewrite-base", "", "If set, inject (or rewrite) a <base href> with this prefix in html pages, for hosting under a subpath")
+	flag.StringVar(&wellKnownDir, "well-known-dir", "", "Serve /.well-known/ from this local directory instead of Dropbox, e.g. for ACME challenges written by external tools")
+	flag.BoolVar(&serverTiming, "server-timing", false, "Emit Server-Timing headers with cache lookup, metadata and download durations")
+	flag.StringVar(&selfcheckPath, "selfcheck-path", "", "A regularly changing file used to verify that changes are detected, reported in /healthz")
+	flag.DurationVar(&selfcheckThreshold, "selfcheck-threshold", 10*time.Minute, "How long a stale version of -selfcheck-path may be served before /healthz fails")
+	flag.DurationVar(&longpollStaleAfter, "longpoll-stale-after", 0, "/healthz fails when no longpoll succeeded for this long, as the cache may be stale. Default 3x -longpoll-timeout")
+	flag.IntVar(&longpollAlertAfter, "longpoll-alert-after", 5, "Consecutive longpoll failures after which /healthz fails and the alert fires. 0 disables")
+	flag.StringVar(&longpollAlertCmd, "longpoll-alert-cmd", "", "Shell command run once when -longpoll-alert-after is reached, with LONGPOLL_FOLDER, LONGPOLL_FAILURES and LONGPOLL_ERROR set")
+	flag.BoolVar(&canonicalIndex, "canonical-index", false, "301 redirect /dir/index.html to /dir/")
+	flag.BoolVar(&suggest, "suggest", false, "On 404, suggest similarly named files from the same directory. Leaks file names, off by default")
+	flag.IntVar(&startupRetries, "startup-retries", 5, "Number of fast retries for the initial longpoll cursor at startup")
+	flag.BoolVar(&preloadLinks, "preload-links", false, "Emit Link headers on html pages from a <page>.links file next to it")
+	keyParams := flag.String("cache-key-params", "", "Comma separated query params that are part of the cache key, all others are ignored")
+	var mountSpecs listFlag
+	flag.Var(&mountSpecs, "mount", "Serve a Dropbox folder under a URL prefix, /prefix:/Dropbox/folder (repeatable). Replaces -folder")
+	var protect listFlag
+	basicUser := flag.String("basic-auth-user", "", "Require basic auth with this user (and -basic-auth-pass) for every file")
+	basicPass := flag.String("basic-auth-pass", "", "Password for -basic-auth-user")
+	flag.Var(&protect, "protect", "Require basic auth for a subtree, /prefix=user:pass (repeatable), or /prefix=public to open a subtree again")
+	invLog := flag.String("invalidation-log", "", "Append a JSON line per cache invalidation (trigger and keys) to this file, - for stderr")
+	minFree := flag.String("min-free-memory", "", "Stop adding cache entries when available memory (cgroup limit or MemAvailable) is below this, e.g. 200MB")
+	classBudget := flag.String("class-budget", "", "Per content type class cache budgets, e.g. image=100MB,text=50MB")
+	flag.BoolVar(&accessLog, "access-log", false, "Log every request: method, path, status, bytes, cache hit/miss and duration")
+	level := flag.String("log-level", "info", "Log level: error, warn, info or debug (which also logs the Dropbox API calls)")
+	flag.StringVar(&logFormat, "log-format", "text", "Access log format, text or json")
+	flag.BoolVar(&metricsPage, "metrics", false, "Serve Prometheus metrics at /metrics, protected by -admin-token if set")
+	flag.BoolVar(&versionPage, "version-page", false, "Serve the version, commit and build date as JSON at /version, which then can't be a file in Dropbox")
+	flag.BoolVar(&statusPage, "status", false, "Serve a human readable status dashboard at /status, protected by -admin-token if set")
+	flag.Float64Var(&rateLimit, "rate-limit", 0, "Requests per second allowed per client IP, 0 disables rate limiting")
+	flag.IntVar(&rateBurst, "rate-burst", 20, "Requests a client IP may make in a burst before -rate-limit applies")
+	flag.BoolVar(&rateMissesOnly, "rate-limit-misses-only", false, "Only count requests that go to Dropbox against -rate-limit, cache hits are never limited")
+	var trustedProxy listFlag
+	flag.Var(&trustedProxy, "trusted-proxy", "IP or CIDR of a reverse proxy whose X-Forwarded-For is trusted for the client IP (repeatable)")
+	var corsOrigin listFlag
+	flag.Var(&corsOrigin, "cors-origin", "Origin allowed to fetch files cross origin (repeatable), * allows any")
+	flag.BoolVar(&nosniff, "nosniff", false, "Send X-Content-Type-Options: nosniff, so browsers trust our Content-Type instead of sniffing")
+	flag.StringVar(&frameOptions, "frame-options", "", "X-Frame-Options header, e.g. DENY or SAMEORIGIN")
+	flag.StringVar(&referrerPolicy, "referrer-policy", "", "Referrer-Policy header, e.g. strict-origin-when-cross-origin")
+	flag.StringVar(&csp, "csp", "", "Content-Security-Policy header")
+	flag.StringVar(&serverHeader, "server-header", "", "Server header to send, none by default")
+	var mimeOverride listFlag
+	flag.StringVar(&defaultContentType, "default-content-type", "application/octet-stream", "Content-Type of files whose extension is unknown or missing, e.g. \"text/plain; charset=utf-8\"")
+	flag.BoolVar(&sniffContent, "sniff-content-type", false, "Guess the Content-Type of cached files with an unknown extension from their first 512 bytes")
+	flag.Var(&mimeOverride, "mime", "Content-Type for an extension, .ext=type (repeatable), e.g. .mjs=text/javascript")
+	var vary listFlag
+	flag.Var(&vary, "vary", "Extra request header downstream caches should vary on (repeatable)")
+	flag.StringVar(&errorFormat, "error-format", "text", "text or json. With json, error responses are JSON unless the client asks for html or plain text. Clients asking for application/json get JSON either way")
+	denyScanners := flag.Bool("deny-scanners", false, "404 common scanner targets (/wp-admin, *.php, /.git/, /.env, ...) without a Dropbox lookup")
+	var denyPattern listFlag
+	flag.Var(&denyPattern, "deny-pattern", "Regexp of paths to 404 without a Dropbox lookup (repeatable)")
+	flag.BoolVar(&logDenied, "log-denied", false, "Log requests rejected by -deny-scanners / -deny-pattern")
+	maxInflight := flag.Int("max-inflight", 0, "Requests handled at once, more get an immediate 503 with Retry-After. /healthz, /readyz and /metrics are exempt. 0 for no limit")
+	maxUpstream := flag.Int("max-upstream-concurrency", 16, "Dropbox fetches that may run at once, further cache misses wait up to 5s for a slot. 0 for no limit")
+	flag.IntVar(&rateLimitRetries, "rate-limit-retries", 2, "Times a rate limited Dropbox call is retried after its Retry-After (capped at 5s) before the client gets a 503")
+	flag.StringVar(&pollMode, "poll-mode", "longpoll", "How changes in Dropbox are picked up: longpoll, ttl (re-check files older than -poll-ttl when requested) or off (only /admin/flush)")
+	flag.DurationVar(&pollTTL, "poll-ttl", 10*time.Minute, "With -poll-mode ttl, how long a cached file is served before it is re-checked with Dropbox")
+	flag.Uint64Var(&longpollTimeout, "longpoll-timeout", 300, "Seconds a longpoll waits for changes, 30 to 480")
+	flag.DurationVar(&longpollBackoffMin, "longpoll-backoff-min", 2*time.Second, "Delay before retrying a failed longpoll, doubled on every further failure")
+	flag.DurationVar(&longpollBackoffMax, "longpoll-backoff-max", 5*time.Minute, "Longest delay between longpoll retries")
+	flag.DurationVar(&longpollMinInterval, "longpoll-min-interval", 5*time.Second, "Minimum time between longpoll cycles, whatever Dropbox returns")
+	flag.BoolVar(&sriHeader, "sri", false, "Send the Subresource Integrity hash (sha384) of every file in an X-Integrity header")
+	flag.BoolVar(&serveStaleOnAuthFailure, "serve-stale-on-auth-failure", false, "Keep serving cached (stale) objects while Dropbox rejects the credentials, instead of erroring")
+	flag.BoolVar(&hashContent, "content-hash", false, "Compute a sha384 of every cached file once at fill time, shown in /admin/inspect. Implied by -sri")
+	flag.StringVar(&cacheControl, "cache-control", "", "Cache-Control header for served files, e.g. \"public, max-age=300\"")
+	flag.StringVar(&surrogateControl, "surrogate-control", "", "Surrogate-Control header for served files, for a CDN in front, e.g. \"max-age=86400, stale-while-revalidate=60, stale-if-error=86400\"")
+	flag.StringVar(&notFoundSurrogateControl, "surrogate-control-404", "max-age=60", "Surrogate-Control header for 404s, only sent when -surrogate-control is set")
+	flag.StringVar(&surrogateHeader, "surrogate-header", "Surrogate-Control", "Header name for -surrogate-control, e.g. CDN-Cache-Control")
+	flag.StringVar(&notFoundCacheControl, "cache-control-404", "public, max-age=60", "Cache-Control header for 404s, only sent when -cache-control is set")
+	flag.BoolVar(&listing, "listing", false, "Serve a JSON listing for directories without an index file")
+	flag.BoolVar(&thumbnails, "thumbnails", false, "Serve Dropbox generated thumbnails of images for ?thumb=w256h256 (and the other Dropbox sizes)")
+	flag.StringVar(&favicon, "favicon", "", "/favicon.ico: empty serves it from Dropbox (204 if missing), none always answers 204 without asking Dropbox, or a path in the folder to serve instead, e.g. /img/icon.png")
+	flag.StringVar(&robots, "robots", "disallow", "robots.txt: disallow (everything), allow (everything) or file (served from Dropbox)")
+	flag.StringVar(&basePath, "base-path", "", "URL prefix this server is mounted under behind a reverse proxy, e.g. /files. It is stripped before the Dropbox lookup and kept in redirects")
+	flag.StringVar(&rootRedirect, "root-redirect", "", "Redirect / to this URL instead of serving the index file of the folder")
+	flag.StringVar(&spaFallback, "spa-fallback", "", "Entrypoint (e.g. /index.html) served with a 200 instead of a 404 for browser requests of paths without an extension, for single page apps")
+	flag.StringVar(&notFoundPage, "404-page", "/404.html", "Path of a page served as the body of 404 responses if it exists, empty to disable")
+	flag.DurationVar(&negativeTTL, "negative-ttl", time.Minute, "Re-check cached 404s with Dropbox after this long, 0 keeps them until the next invalidation")
+	flag.BoolVar(&caseSensitiveCache, "case-sensitive-cache", false, "Cache /File.txt and /file.txt separately, as before paths were lower cased for the cache key")
+	flag.StringVar(&bigDir, "big-file-dir", "", "Keep files too big for the memory cache in this directory, up to -big-file-max-size each")
+	bigMax := flag.String("big-file-max-size", "100MB", "Largest file kept in -big-file-dir, bigger ones are always streamed from Dropbox")
+	bigTotal := flag.String("big-file-max-bytes", "10GB", "Total size of the files in -big-file-dir, least recently used ones are removed beyond it")
+	flag.IntVar(&batchWorkers, "batch-workers", 4, "Paths fetched at once by bulk operations like -preload")
+	preloadSpec := flag.String("preload", "", "Paths to fetch into the cache at startup, comma separated or @file with one per line")
+	flag.StringVar(&cacheDir, "cache-dir", "", "Also keep cached objects in this directory and reload them on startup, revalidated against Dropbox on first use")
+	flag.BoolVar(&honorNoCache, "honor-no-cache", false, "Requests with Cache-Control: no-cache or no-store check the file with Dropbox instead of being served from the cache")
+	flag.DurationVar(&noCacheInterval, "honor-no-cache-interval", 10*time.Second, "With -honor-no-cache, files fetched less than this long ago are still served from the cache")
+	flag.BoolVar(&noCache, "no-cache", false, "Development mode: don't cache anything, every request reflects the current Dropbox state (slow, one API call or more per request)")
+	tempAbove := flag.String("temp-link-above", "", "302 redirect downloads of files bigger than this (e.g. 100MB) to a Dropbox temporary link instead of proxying them, empty to always proxy")
+	maxFile := flag.String("max-file-size", "", "Refuse (413) files bigger than this, or redirect them to a temporary link with -temp-link-above. Empty for no limit")
+	maxSize := flag.String("max-cache-size", "1MB", "Largest object that is cached, bigger files are streamed from Dropbox")
+	cacheMax := flag.String("cache-max-bytes", "256MB", "Total size of cached bodies, least recently used objects are evicted beyond it")
+	flag.BoolVar(&precompressed, "precompressed", false, "Serve <file>.br / <file>.gz from Dropbox, when they exist, to clients accepting them instead of compressing <file> ourselves")
+	gzLevel := flag.String("gzip-level", "default", "gzip compression level, 1 (fastest) to 9 (smallest), default, best-speed or best-compression")
+	flag.BoolVar(&tlsSessionTickets, "tls-session-tickets", true, "Allow TLS session resumption via session tickets")
+	tlsMin := flag.String("tls-min-version", "1.2", "Minimum TLS version: 1.0, 1.1, 1.2 or 1.3")
+	flag.DurationVar(&readHeaderTimeout, "read-header-timeout", 10*time.Second, "Time a client has to send the request headers, guards against slowloris")
+	flag.DurationVar(&readTimeout, "read-timeout", 10*time.Second, "Time a client has to send the whole request")
+	flag.DurationVar(&writeTimeout, "write-timeout", 10*time.Minute, "Longest a response may take to write, including slow downloads of big files. 0 for no limit")
+	flag.DurationVar(&idleTimeout, "idle-timeout", 2*time.Minute, "How long an idle keep-alive connection is kept open")
+	flag.BoolVar(&keepAlives, "keep-alives", true, "Enable HTTP keep-alive connection reuse")
+	flag.BoolVar(&archives, "archive", false, "Allow downloading a folder as an archive with /dir/?download=zip or ?download=tar.gz")
+	archiveMax := flag.String("archive-max-bytes", "1GB", "Largest total size of files in a folder archive")
+	flag.IntVar(&archiveConcurrency, "archive-concurrency", 4, "Dropbox downloads opened ahead while streaming an archive")
+	check := flag.Bool("check", false, "Validate the flags, the Dropbox credentials and the served folders, then exit (non zero on failure) without serving")
+	addr := flag.String("addr", ":8889", "Listen address for plain http when -hostname is not set, e.g. :8080, 127.0.0.1:8080 or just 8080")
+	flag.DurationVar(&shutdownTimeout, "shutdown-timeout", 15*time.Second, "On SIGINT/SIGTERM, how long to wait for in-flight requests before exiting")
 	flag.Parse()
-	config := dropbox.Config{Token: os.Getenv("ACCESS_TOKEN")} // second arg enables verbose logging in the SDK
+	rand.Seed(time.Now().UnixNano())
+	if pollMode != "longpoll" && pollMode != "ttl" && pollMode != "off" {
+		log.Fatal("-poll-mode must be longpoll, ttl or off")
+	}
+	if pollMode == "ttl" && pollTTL <= 0 {
+		log.Fatal("-poll-ttl must be positive")
+	}
+	if longpollTimeout < 30 || longpollTimeout > 480 {
+		log.Fatal("-longpoll-timeout must be between 30 and 480 seconds")
+	}
+	if longpollBackoffMin <= 0 || longpollBackoffMax < longpollBackoffMin {
+		log.Fatal("-longpoll-backoff-min must be positive and at most -longpoll-backoff-max")
+	}
+	//Forgive a bare port number
+	if _, err := strconv.Atoi(*addr); err == nil {
+		*addr = ":" + *addr
+	}
+	if n, err := parseSize(*archiveMax); err != nil {
+		log.Fatal("-archive-max-bytes: ", err)
+	} else {
+		archiveMaxBytes = n
+	}
+	if archiveConcurrency < 1 {
+		log.Fatal("-archive-concurrency must be at least 1")
+	}
+	switch *tlsMin {
+	case "1.0":
+		tlsMinVersion = tls.VersionTLS10
+	case "1.1":
+		tlsMinVersion = tls.VersionTLS11
+	case "1.2":
+		tlsMinVersion = tls.VersionTLS12
+	case "1.3":
+		tlsMinVersion = tls.VersionTLS13
+	default:
+		log.Fatal("-tls-min-version must be 1.0, 1.1, 1.2 or 1.3")
+	}
+	if n, err := parseSize(*maxSize); err != nil {
+		log.Fatal("-max-cache-size: ", err)
+	} else if n <= 0 {
+		log.Fatal("-max-cache-size must be positive")
+	} else {
+		maxCacheSize = n
+	}
+	if *maxFile != "" {
+		n, err := parseSize(*maxFile)
+		if err != nil {
+			log.Fatal("-max-file-size: ", err)
+		}
+		maxFileSize = n
+	}
+	if *tempAbove != "" {
+		n, err := parseSize(*tempAbove)
+		if err != nil {
+			log.Fatal("-temp-link-above: ", err)
+		}
+		tempLinkAbove = n
+	}
+	if n, err := parseSize(*bigMax); err != nil {
+		log.Fatal("-big-file-max-size: ", err)
+	} else {
+		bigMaxSize = n
+	}
+	if n, err := parseSize(*bigTotal); err != nil {
+		log.Fatal("-big-file-max-bytes: ", err)
+	} else {
+		bigMaxBytes = n
+	}
+	for _, d := range []struct{ flag, dir string }{{"-cache-dir", cacheDir}, {"-big-file-dir", bigDir}, {"-acme-cache", *acmeCache}} {
+		if d.dir == "" {
+			continue
+		}
+		if err := checkWritable(d.dir); err != nil {
+			log.Fatalf("%s: %s is not writable: %v", d.flag, d.dir, err)
+		}
+	}
+	if bigDir != "" && !*check {
+		if err := clearBigDir(); err != nil {
+			log.Fatal("-big-file-dir: ", err)
+		}
+	}
+	if n, err := parseSize(*cacheMax); err != nil {
+		log.Fatal("-cache-max-bytes: ", err)
+	} else {
+		cacheMaxBytes = n
+	}
+	if l, err := parseLogLevel(*level); err != nil {
+		log.Fatal("-log-level: ", err)
+	} else {
+		logLevelSet = l
+	}
+	if n, err := parseGzipLevel(*gzLevel); err != nil {
+		log.Fatal("-gzip-level: ", err)
+	} else {
+		gzipLevel = n
+	}
+	if sriHeader {
+		hashContent = true
+	}
+	if err := setDenyPatterns(*denyScanners, denyPattern); err != nil {
+		log.Fatal("-deny-pattern: ", err)
+	}
+	if *maxUpstream > 0 {
+		upstreamSlots = make(chan struct{}, *maxUpstream)
+	}
+	if *maxInflight > 0 {
+		inflightSlots = make(chan struct{}, *maxInflight)
+	}
+	if basePath = strings.TrimSuffix(basePath, "/"); basePath != "" && !strings.HasPrefix(basePath, "/") {
+		log.Fatal("-base-path must start with /")
+	}
+	if frameOptions != "" && !strings.EqualFold(frameOptions, "DENY") && !strings.EqualFold(frameOptions, "SAMEORIGIN") {
+		log.Fatal("-frame-options must be DENY or SAMEORIGIN")
+	}
+	if err := parseMimeOverrides(mimeOverride); err != nil {
+		log.Fatal(err)
+	}
+	if surrogateControl != "" && surrogateHeader == "" {
+		log.Fatal("-surrogate-header can't be empty with -surrogate-control")
+	}
+	if favicon != "" && favicon != "none" && !strings.HasPrefix(favicon, "/") {
+		log.Fatal("-favicon must be none or a path starting with /")
+	}
+	if robots != "disallow" && robots != "allow" && robots != "file" {
+		log.Fatal("-robots must be disallow, allow or file")
+	}
+	if logFormat != "text" && logFormat != "json" {
+		log.Fatal("-log-format must be text or json")
+	}
+	if errorFormat != "text" && errorFormat != "json" {
+		log.Fatal("-error-format must be text or json")
+	}
+	extraVary = vary
+	if err := parseTrustedProxies(trustedProxy); err != nil {
+		log.Fatal("-trusted-proxy: ", err)
+	}
+	if rateLimit > 0 {
+		if rateBurst < 1 {
+			log.Fatal("-rate-burst must be at least 1")
+		}
+		go limiter.cleanuploop()
+	}
+	corsOrigins = corsOrigin
+	for _, p := range strings.Split(*keyParams, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			cacheKeyParams = append(cacheKeyParams, p)
+		}
+	}
+	if err := parseClassBudgets(*classBudget); err != nil {
+		log.Fatal(err)
+	}
+	if noCache {
+		logln(levelWarn, "-no-cache: every request goes to Dropbox")
+	} else if cacheDir != "" && !*check {
+		if err := loadCache(dbcache); err != nil {
+			log.Fatal("-cache-dir: ", err)
+		}
+	}
+	if err := parseMounts(mountSpecs); err != nil {
+		log.Fatal("-mount: ", err)
+	}
+	if len(mounts) == 0 {
+		mounts = []mount{{prefix: "", folder: folder}}
+	}
+	if *basicUser != "" || *basicPass != "" {
+		if *basicUser == "" || *basicPass == "" {
+			log.Fatal("-basic-auth-user and -basic-auth-pass must be set together")
+		}
+		//Same as protecting /, more specific -protect rules still win
+		protect = append(protect, "/="+*basicUser+":"+*basicPass)
+	}
+	if err := parseAccessRules(protect); err != nil {
+		log.Fatal("-protect: ", err)
+	}
+	if *invLog != "" {
+		if err := invalidationLog.open(*invLog); err != nil {
+			log.Fatal("-invalidation-log: ", err)
+		}
+	}
+	if *minFree != "" {
+		n, err := parseSize(*minFree)
+		if err != nil {
+			log.Fatal("-min-free-memory: ", err)
+		}
+		minFreeMemory = n
+		go memoryloop()
+	}
+	config := dropbox.Config{Token: os.Getenv("ACCESS_TOKEN")}
+	if logLevelSet >= levelDebug {
+		//The SDK's LogInfo also includes its LogDebug output, requests and responses
+		config.LogLevel = dropbox.LogInfo
+	}
+	if rt := os.Getenv("REFRESH_TOKEN"); rt != "" {
+		//Short lived access tokens, oauth2 gets a new one from the refresh token whenever it expires
+		if os.Getenv("CLIENT_ID") == "" {
+			log.Fatal("REFRESH_TOKEN needs CLIENT_ID (and CLIENT_SECRET unless the app uses PKCE)")
+		}
+		conf := &oauth2.Config{
+			ClientID:     os.Getenv("CLIENT_ID"),
+			ClientSecret: os.Getenv("CLIENT_SECRET"),
+			Endpoint:     oauth2.Endpoint{TokenURL: "https://api.dropboxapi.com/oauth2/token"},
+		}
+		config.Client = conf.Client(context.Background(), &oauth2.Token{RefreshToken: rt})
+	} else if config.Token == "" {
+		log.Fatal("Neither REFRESH_TOKEN nor ACCESS_TOKEN is set. Create an app at https://www.dropbox.com/developers and set REFRESH_TOKEN, CLIENT_ID and CLIENT_SECRET (or ACCESS_TOKEN)")
+	}
+	config.AsMemberID = asMember
+	if pathRoot != "" {
+		h, err := pathRootHeader(pathRoot)
+		if err != nil {
+			log.Fatal(err)
+		}
+		config.HeaderGenerator = func(hostType, style, namespace, route string) map[string]string {
+			return map[string]string{"Dropbox-API-Path-Root": h}
+		}
+	}
 	db = files.New(config)
-	//db = dropbox.NewDropbox()
-	//db.SetAppInfo(os.Getenv("CLIENT_ID"), os.Getenv("CLIENT_SECRET"))
-	//db.SetAccessToken(os.Getenv("ACCESS_TOKEN"))
-	go longpollloop()
+	checkFolders(*check)
+	if *check {
+		logln(levelInfo, "Check passed: flags parse, the credentials work and every folder exists")
+		return
+	}
+	if pollMode == "longpoll" {
+		for _, f := range watchedFolders() {
+			go longpollloop(f)
+		}
+	} else {
+		//No cursor to wait for
+		atomic.StoreInt32(&ready, 1)
+	}
+	if selfcheckPath != "" {
+		go selfcheckloop()
+	}
+	if batchWorkers < 1 {
+		log.Fatal("-batch-workers must be at least 1")
+	}
+	if *preloadSpec != "" {
+		paths, err := preloadPaths(*preloadSpec)
+		if err != nil {
+			log.Fatal("-preload: ", err)
+		}
+		//In the background, requests for paths not loaded yet just fill them as usual
+		go preload(paths)
+	}
 	//http.HandleFunc("/", dbhandler)
-	if *hostname != "" {
+	var servers []*http.Server
+	errc := make(chan error, 2)
+	var hosts []string
+	for _, h := range hostnames {
+		for _, h := range strings.Split(h, ",") {
+			if h = strings.TrimSpace(h); h != "" {
+				hosts = append(hosts, h)
+			}
+		}
+	}
+	if len(hosts) > 0 {
 		m := autocert.Manager{
 			Prompt:     autocert.AcceptTOS,
-			HostPolicy: autocert.HostWhitelist(*hostname),
-		}
-		s := &http.Server{
-			Addr:           ":https",
-			TLSConfig:      &tls.Config{GetCertificate: m.GetCertificate},
-			Handler:        gziphandler.GzipHandler(http.HandlerFunc(dbhandler)),
-			ReadTimeout:    10 * time.Second,
-			WriteTimeout:   10 * time.Second,
-			MaxHeaderBytes: 1 << 20,
-		}
-		log.Println("Listening on :https")
-		go http.ListenAndServe(":http", m.HTTPHandler(nil))
-		//TODO: If we are listening on https, then maybe we should listen and redirect http to https also...
-		log.Fatal(s.ListenAndServeTLS("", ""))
+			HostPolicy: autocert.HostWhitelist(hosts...),
+		}
+		if *acmeCache != "" {
+			m.Cache = autocert.DirCache(*acmeCache)
+		}
+		s := newServer(":https", newHandler())
+		s.TLSConfig = tlsConfig(m.GetCertificate)
+		//Plain http only answers ACME challenges and redirects everything else to
+		//https, except what a trusted proxy says already was https
+		redirect := newServer(":http", m.HTTPHandler(httpsOnly(newHandler())))
+		servers = append(servers, s, redirect)
+		logln(levelInfo, "Listening on :https")
+		go func() { errc <- redirect.ListenAndServe() }()
+		go func() { errc <- s.ListenAndServeTLS("", "") }()
 	} else {
-		s := &http.Server{
-			Addr:           ":8889",
-			Handler:        gziphandler.GzipHandler(http.HandlerFunc(dbhandler)),
-			ReadTimeout:    10 * time.Second,
-			WriteTimeout:   10 * time.Second,
-			MaxHeaderBytes: 1 << 20,
-		}
-		log.Println("Listening on :8889")
-		log.Fatal(s.ListenAndServe())
+		h := newHandler()
+		if forceHTTPS {
+			h = httpsOnly(h)
+		}
+		s := newServer(*addr, h)
+		servers = append(servers, s)
+		logln(levelInfo, "Listening on", *addr)
+		go func() { errc <- s.ListenAndServe() }()
+	}
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case err := <-errc:
+		log.Fatal(err)
+	case sig := <-sigc:
+		logln(levelInfo, "Got", sig, "shutting down")
+	}
+	close(quit)
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	for _, s := range servers {
+		//Waits for in-flight requests, like long downloads, to finish
+		if err := s.Shutdown(ctx); err != nil {
+			logln(levelError, "Shutdown:", err)
+		}
 	}
 }
@@ -0,0 +1,604 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dropbox/dropbox-sdk-go-unofficial/dropbox"
+	"github.com/dropbox/dropbox-sdk-go-unofficial/dropbox/files"
+)
+
+func TestMetadataTypes(t *testing.T) {
+	tests := []struct {
+		name   string
+		setup  func(fake *fakeDropbox)
+		status int
+		body   string //Of the GET
+	}{
+		{"file", func(fake *fakeDropbox) { fake.put("/Public/x", "data") }, http.StatusOK, "data"},
+		{"folder", func(fake *fakeDropbox) { fake.folders["/public/x"] = true }, http.StatusMovedPermanently, ""},
+		{"deleted", func(fake *fakeDropbox) { fake.metadata["/public/x"] = files.NewDeletedMetadata("x") }, http.StatusNotFound, ""},
+		{"unexpected", func(fake *fakeDropbox) { fake.metadata["/public/x"] = &files.Metadata{Name: "x"} }, http.StatusInternalServerError, ""},
+	}
+	for _, tt := range tests {
+		for _, method := range []string{"GET", "HEAD"} {
+			t.Run(tt.name+"/"+method, func(t *testing.T) {
+				fake := newFakeDropbox()
+				tt.setup(fake)
+				h := testHandler(t, fake)
+				w := request(h, method, "/x")
+				if w.Code != tt.status {
+					t.Fatalf("%s /x = %d, want %d", method, w.Code, tt.status)
+				}
+				if method == "GET" && tt.body != "" && w.Body.String() != tt.body {
+					t.Errorf("body %q, want %q", w.Body.String(), tt.body)
+				}
+				if tt.status == http.StatusMovedPermanently && w.Header().Get("Location") != "/x/" {
+					t.Errorf("Location %q, want /x/", w.Header().Get("Location"))
+				}
+				if n := fake.count("get_metadata /public/x"); n != 1 {
+					t.Errorf("%d get_metadata calls, want 1", n)
+				}
+				if method == "HEAD" && fake.count("download") != 0 {
+					t.Error("HEAD downloaded the body")
+				}
+			})
+		}
+	}
+}
+
+func TestUnexpectedMetadataNotCached(t *testing.T) {
+	fake := newFakeDropbox()
+	fake.metadata["/public/x"] = &files.Metadata{Name: "x"}
+	h := testHandler(t, fake)
+	request(h, "GET", "/x")
+	request(h, "GET", "/x")
+	if n := fake.count("get_metadata /public/x"); n != 2 {
+		t.Errorf("%d get_metadata calls, want 2: the 500 must not be cached", n)
+	}
+}
+
+func TestContentTypeFor(t *testing.T) {
+	gz := mime.TypeByExtension(".gz")
+	if gz == "" {
+		gz = defaultContentType
+	}
+	tests := []struct {
+		key  string
+		want string
+	}{
+		{"/a.b/c", defaultContentType},
+		{"/a.b/c.css", "text/css; charset=utf-8"},
+		{"/archive.tar.gz", gz},
+		{"/data.JSON", "application/json"},
+		{"/noext", defaultContentType},
+	}
+	for _, tt := range tests {
+		if got := contentTypeFor(tt.key); got != tt.want {
+			t.Errorf("contentTypeFor(%q) = %q, want %q", tt.key, got, tt.want)
+		}
+	}
+}
+
+//The ETag line as it goes over the wire, net/http writes the name as Etag
+func TestETagHeaderBytes(t *testing.T) {
+	fake := newFakeDropbox()
+	file := fake.put("/Public/f.txt", strings.Repeat("text ", 1000))
+	srv := httptest.NewServer(testHandler(t, fake))
+	defer srv.Close()
+	for enc, want := range map[string]string{"": `"` + file.rev + `"`, "gzip": `"` + file.rev + `-gzip"`} {
+		conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := "GET /f.txt HTTP/1.1\r\nHost: example.com\r\nConnection: close\r\n"
+		if enc != "" {
+			req += "Accept-Encoding: " + enc + "\r\n"
+		}
+		fmt.Fprint(conn, req+"\r\n")
+		raw, err := ioutil.ReadAll(conn)
+		conn.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		head := string(raw[:bytes.Index(raw, []byte("\r\n\r\n"))])
+		var lines []string
+		for _, l := range strings.Split(head, "\r\n") {
+			if strings.HasPrefix(strings.ToLower(l), "etag:") {
+				lines = append(lines, l)
+			}
+		}
+		if len(lines) != 1 || lines[0] != "Etag: "+want {
+			t.Errorf("Accept-Encoding %q: ETag lines %q, want [Etag: %s]", enc, lines, want)
+		}
+	}
+}
+
+//lookupError is a GetMetadata path error with the LookupError tag
+func lookupError(tag string) error {
+	return files.GetMetadataAPIError{EndpointError: &files.GetMetadataError{
+		Tagged: dropbox.Tagged{Tag: files.GetMetadataErrorPath},
+		Path:   &files.LookupError{Tagged: dropbox.Tagged{Tag: tag}},
+	}}
+}
+
+func TestIsNotFound(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"not_found", notFoundError(), true},
+		{"malformed_path", lookupError(files.LookupErrorMalformedPath), false},
+		{"restricted_content", lookupError(files.LookupErrorRestrictedContent), false},
+		{"no path error", files.GetMetadataAPIError{EndpointError: &files.GetMetadataError{Tagged: dropbox.Tagged{Tag: files.GetMetadataErrorPath}}}, false},
+		{"no endpoint error", files.GetMetadataAPIError{}, false},
+		{"list_folder not_found", files.ListFolderAPIError{EndpointError: &files.ListFolderError{
+			Tagged: dropbox.Tagged{Tag: files.ListFolderErrorPath},
+			Path:   &files.LookupError{Tagged: dropbox.Tagged{Tag: files.LookupErrorNotFound}},
+		}}, true},
+		{"text mentioning not_found", fmt.Errorf("proxy said path/not_found/"), false},
+		{"nil", nil, false},
+	}
+	for _, tt := range tests {
+		if got := isNotFound(tt.err); got != tt.want {
+			t.Errorf("%s: isNotFound = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+//Only a real not_found is cached as a 404, the rest are upstream errors
+//asked again by the next request
+func TestLookupErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		err    error
+		status int
+		calls  int //get_metadata calls after two GETs
+	}{
+		{"not_found", nil, http.StatusNotFound, 1},
+		{"restricted_content", lookupError(files.LookupErrorRestrictedContent), http.StatusBadGateway, 2},
+		{"network", fmt.Errorf("read tcp: connection reset (not_found)"), http.StatusBadGateway, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeDropbox()
+			if tt.err != nil {
+				fake.errs["/public/x"] = tt.err
+			}
+			h := testHandler(t, fake)
+			for i := 0; i < 2; i++ {
+				if w := request(h, "GET", "/x"); w.Code != tt.status {
+					t.Errorf("GET %d = %d, want %d", i+1, w.Code, tt.status)
+				}
+			}
+			if n := fake.count("get_metadata /public/x"); n != tt.calls {
+				t.Errorf("%d get_metadata calls, want %d", n, tt.calls)
+			}
+		})
+	}
+}
+
+//A folder is neither a file nor a 404
+func TestFolderPath(t *testing.T) {
+	fake := newFakeDropbox()
+	fake.put("/Public/site/index.html", "<p>home</p>")
+	fake.folders["/public/empty"] = true
+	h := testHandler(t, fake)
+	tests := []struct {
+		target   string
+		status   int
+		location string
+	}{
+		{"/site", http.StatusMovedPermanently, "/site/"},
+		{"/site/", http.StatusOK, ""},
+		{"/empty", http.StatusMovedPermanently, "/empty/"},
+		{"/empty/", http.StatusNotFound, ""},
+	}
+	for _, tt := range tests {
+		w := request(h, "GET", tt.target)
+		if w.Code != tt.status || w.Header().Get("Location") != tt.location {
+			t.Errorf("GET %s = %d Location %q, want %d %q", tt.target, w.Code, w.Header().Get("Location"), tt.status, tt.location)
+		}
+	}
+	//Served from the cache this time
+	if w := request(h, "GET", "/site"); w.Code != http.StatusMovedPermanently {
+		t.Errorf("cached folder = %d, want 301", w.Code)
+	}
+	if n := fake.count("get_metadata /public/site"); n != 1 {
+		t.Errorf("%d get_metadata calls for the folder, want 1", n)
+	}
+}
+
+//No longpoll answer, not even an immediate error, may make us call Dropbox
+//more often than longpollMinInterval
+func TestLongpollRestartFloor(t *testing.T) {
+	oldMin, oldBackoffMin, oldBackoffMax, oldQuit := longpollMinInterval, longpollBackoffMin, longpollBackoffMax, quit
+	defer func() {
+		longpollMinInterval, longpollBackoffMin, longpollBackoffMax, quit = oldMin, oldBackoffMin, oldBackoffMax, oldQuit
+	}()
+	longpollMinInterval = 50 * time.Millisecond
+	longpollBackoffMin = time.Millisecond
+	longpollBackoffMax = 2 * time.Millisecond
+	reset := files.ListFolderLongpollAPIError{EndpointError: &files.ListFolderLongpollError{Tagged: dropbox.Tagged{Tag: files.ListFolderLongpollErrorReset}}}
+	tests := []struct {
+		name string
+		err  error
+	}{
+		{"error", fmt.Errorf("connection refused")},
+		{"reset", reset},
+		{"no changes", nil},
+	}
+	const run = 500 * time.Millisecond
+	for _, tt := range tests {
+		fake := newFakeDropbox()
+		if tt.err != nil {
+			fake.errs[""] = tt.err
+		}
+		testHandler(t, fake)
+		quit = make(chan struct{})
+		done := make(chan struct{})
+		go func() {
+			longpollloop("/Public")
+			close(done)
+		}()
+		time.Sleep(run)
+		close(quit)
+		<-done
+		max := int(run/longpollMinInterval) + 1
+		if n := fake.count("list_folder_longpoll"); n < 2 || n > max {
+			t.Errorf("%s: %d longpolls in %v, want 2 to %d", tt.name, n, run, max)
+		}
+	}
+}
+
+func TestValidPath(t *testing.T) {
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{"/a b/ünïcode.txt", true},
+		{"/nul\x00", false},
+		{"/tab\t", false},
+		{"/unit\x1f", false},
+		{"/del\x7f", false},
+		{"/c1\u0085", false},
+		{"/bad\xff", false},
+		{"/cut\xc3", false},
+	}
+	for _, tt := range tests {
+		if got := validPath(tt.path); got != tt.want {
+			t.Errorf("validPath(%q) = %v, want %v", tt.path, got, tt.want)
+		}
+	}
+}
+
+//Bad paths never reach Dropbox, odd ones are redirected to their clean form
+func TestRequestPaths(t *testing.T) {
+	fake := newFakeDropbox()
+	h := testHandler(t, fake)
+	tests := []struct {
+		target   string
+		status   int
+		location string
+	}{
+		{"/a%00b", http.StatusBadRequest, ""},
+		{"/a%0Ab", http.StatusBadRequest, ""},
+		{"/a%FFb", http.StatusBadRequest, ""},
+		{"/a/../../etc/passwd", http.StatusMovedPermanently, "/etc/passwd"},
+		{"//a//b", http.StatusMovedPermanently, "/a/b"},
+		{"/a/./b", http.StatusMovedPermanently, "/a/b"},
+	}
+	for _, tt := range tests {
+		w := request(h, "GET", tt.target)
+		if w.Code != tt.status || w.Header().Get("Location") != tt.location {
+			t.Errorf("GET %s = %d Location %q, want %d %q", tt.target, w.Code, w.Header().Get("Location"), tt.status, tt.location)
+		}
+	}
+	if n := fake.count("get_metadata"); n != 0 {
+		t.Errorf("%d get_metadata calls, want none", n)
+	}
+}
+
+func TestETagMatch(t *testing.T) {
+	tests := []struct {
+		header       string
+		weak, strong bool
+	}{
+		{`"abc"`, true, true},
+		{`"abc-gzip"`, true, true},
+		{`"abc-br"`, true, true},
+		{`W/"abc"`, true, false},
+		{`"x", "abc"`, true, true},
+		{`"x",W/"abc"`, true, false},
+		{`*`, true, true},
+		{`"x", "y"`, false, false},
+		{`"abcd"`, false, false},
+		{`W/"x"`, false, false},
+	}
+	for _, tt := range tests {
+		if got := etagWeakMatch(tt.header, "abc"); got != tt.weak {
+			t.Errorf("etagWeakMatch(%s) = %v, want %v", tt.header, got, tt.weak)
+		}
+		if got := etagStrongMatch(tt.header, "abc"); got != tt.strong {
+			t.Errorf("etagStrongMatch(%s) = %v, want %v", tt.header, got, tt.strong)
+		}
+	}
+}
+
+func TestIfNoneMatch(t *testing.T) {
+	fake := newFakeDropbox()
+	file := fake.put("/Public/f.txt", "data")
+	h := testHandler(t, fake)
+	tag := `"` + file.rev + `"`
+	tests := []struct {
+		target, inm string
+		status      int
+	}{
+		{"/f.txt", tag, http.StatusNotModified},
+		{"/f.txt", `"old", ` + tag, http.StatusNotModified},
+		{"/f.txt", "W/" + tag, http.StatusNotModified},
+		{"/f.txt", "*", http.StatusNotModified},
+		{"/f.txt", `"old"`, http.StatusOK},
+		{"/missing.txt", "*", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		for _, method := range []string{"GET", "HEAD"} {
+			if w := request(h, method, tt.target, "If-None-Match", tt.inm); w.Code != tt.status {
+				t.Errorf("%s %s If-None-Match %s = %d, want %d", method, tt.target, tt.inm, w.Code, tt.status)
+			}
+		}
+	}
+}
+
+//Clients resume TLS sessions unless -tls-session-tickets=false, and nothing
+//older than -tls-min-version is accepted
+func TestTLSConfig(t *testing.T) {
+	defer func(tickets bool) { tlsSessionTickets = tickets }(tlsSessionTickets)
+	for _, tickets := range []bool{true, false} {
+		tlsSessionTickets = tickets
+		srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		//nil makes crypto/tls fall back to the httptest certificate
+		srv.TLS = tlsConfig(func(*tls.ClientHelloInfo) (*tls.Certificate, error) { return nil, nil })
+		srv.StartTLS()
+		pool := x509.NewCertPool()
+		pool.AddCert(srv.Certificate())
+		cfg := &tls.Config{RootCAs: pool, ServerName: "example.com", ClientSessionCache: tls.NewLRUClientSessionCache(1)}
+		var resumed []bool
+		for i := 0; i < 2; i++ {
+			conn, err := tls.Dial("tcp", srv.Listener.Addr().String(), cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			//Read the response, TLS 1.3 tickets arrive after the handshake
+			fmt.Fprint(conn, "GET / HTTP/1.1\r\nHost: example.com\r\nConnection: close\r\n\r\n")
+			ioutil.ReadAll(conn)
+			resumed = append(resumed, conn.ConnectionState().DidResume)
+			conn.Close()
+		}
+		if resumed[0] || resumed[1] != tickets {
+			t.Errorf("tickets=%v: resumed %v, want [false %v]", tickets, resumed, tickets)
+		}
+		old := &tls.Config{RootCAs: pool, ServerName: "example.com", MaxVersion: tls.VersionTLS11}
+		if conn, err := tls.Dial("tcp", srv.Listener.Addr().String(), old); err == nil {
+			conn.Close()
+			t.Error("TLS 1.1 handshake succeeded, want it refused")
+		}
+		srv.Close()
+	}
+}
+
+func TestNewServer(t *testing.T) {
+	defer func(keep bool, rh, rd, wr, idle time.Duration) {
+		keepAlives, readHeaderTimeout, readTimeout, writeTimeout, idleTimeout = keep, rh, rd, wr, idle
+	}(keepAlives, readHeaderTimeout, readTimeout, writeTimeout, idleTimeout)
+	readHeaderTimeout, readTimeout, writeTimeout, idleTimeout = time.Second, 2*time.Second, 3*time.Second, 4*time.Second
+	for _, keep := range []bool{true, false} {
+		keepAlives = keep
+		h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+		s := newServer(":0", h)
+		if s.ReadHeaderTimeout != time.Second || s.ReadTimeout != 2*time.Second || s.WriteTimeout != 3*time.Second || s.IdleTimeout != 4*time.Second {
+			t.Errorf("timeouts %v %v %v %v, want the -read-header-timeout etc. values", s.ReadHeaderTimeout, s.ReadTimeout, s.WriteTimeout, s.IdleTimeout)
+		}
+		srv := httptest.NewUnstartedServer(h)
+		srv.Config = s
+		srv.Start()
+		resp, err := http.Get(srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.Close == keep {
+			t.Errorf("keepAlives=%v: Connection: close is %v", keep, resp.Close)
+		}
+		srv.Close()
+	}
+}
+
+//The answer for a client side route depends on Accept, caches must know
+func TestSPAFallbackVary(t *testing.T) {
+	defer func(p string) { spaFallback = p }(spaFallback)
+	spaFallback = "/index.html"
+	fake := newFakeDropbox()
+	fake.put("/Public/index.html", "<p>app</p>")
+	h := testHandler(t, fake)
+	tests := []struct {
+		accept string
+		status int
+	}{
+		{"text/html,application/xhtml+xml", http.StatusOK},
+		{"application/json", http.StatusNotFound},
+		{"", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		w := request(h, "GET", "/settings/profile", "Accept", tt.accept)
+		if w.Code != tt.status {
+			t.Errorf("Accept %q: %d, want %d", tt.accept, w.Code, tt.status)
+		}
+		if !varies(w, "Accept") {
+			t.Errorf("Accept %q: Vary %q, want Accept", tt.accept, w.Header()["Vary"])
+		}
+	}
+}
+
+//Without -version-page /version is a path like any other
+func TestVersionPage(t *testing.T) {
+	defer func(v bool) { versionPage = v }(versionPage)
+	fake := newFakeDropbox()
+	fake.put("/Public/version", "from dropbox")
+	h := testHandler(t, fake)
+	versionPage = false
+	if w := request(h, "GET", "/version"); w.Body.String() != "from dropbox" {
+		t.Errorf("GET /version = %q, want the Dropbox file", w.Body.String())
+	}
+	versionPage = true
+	w := request(h, "GET", "/version")
+	var v map[string]string
+	if err := json.Unmarshal(w.Body.Bytes(), &v); err != nil || v["version"] != version {
+		t.Errorf("GET /version with -version-page = %q, want the version JSON", w.Body.String())
+	}
+}
+
+//OPTIONS anywhere, * included, is a 204 with the methods we serve and no
+//Dropbox call
+func TestOptions(t *testing.T) {
+	fake := newFakeDropbox()
+	fake.put("/Public/f.txt", "f")
+	srv := httptest.NewUnstartedServer(testHandler(t, fake))
+	srv.Config = newServer(":0", srv.Config.Handler)
+	srv.Start()
+	defer srv.Close()
+	for _, target := range []string{"*", "/f.txt", "/missing"} {
+		conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprintf(conn, "OPTIONS %s HTTP/1.1\r\nHost: example.com\r\nConnection: close\r\n\r\n", target)
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		conn.Close()
+		if resp.StatusCode != http.StatusNoContent || resp.Header.Get("Allow") != "GET, HEAD, OPTIONS" {
+			t.Errorf("OPTIONS %s = %d Allow %q, want 204 Allow GET, HEAD, OPTIONS", target, resp.StatusCode, resp.Header.Get("Allow"))
+		}
+	}
+	if n := fake.count("get_metadata"); n != 0 {
+		t.Errorf("%d get_metadata calls, want none", n)
+	}
+}
+
+//A path Dropbox would reject is refused before calling it
+func TestPathTooLong(t *testing.T) {
+	fake := newFakeDropbox()
+	h := testHandler(t, fake)
+	w := request(h, "GET", "/"+strings.Repeat("a", maxPathLength))
+	if w.Code != http.StatusRequestURITooLong {
+		t.Errorf("GET over-length path = %d, want 414", w.Code)
+	}
+	if n := fake.count("get_metadata"); n != 0 {
+		t.Errorf("%d get_metadata calls, want none", n)
+	}
+	//Just short enough is looked up
+	w = request(h, "GET", "/"+strings.Repeat("a", maxPathLength-len("/Public/")))
+	if w.Code != http.StatusNotFound || fake.count("get_metadata") == 0 {
+		t.Errorf("GET longest path = %d after %d get_metadata calls, want a looked up 404", w.Code, fake.count("get_metadata"))
+	}
+}
+
+//Preconditions are evaluated the same for cached and streamed files
+func TestPreconditions(t *testing.T) {
+	fake := newFakeDropbox()
+	file := fake.put("/Public/f.bin", "0123456789")
+	etag := `"` + file.rev + `"`
+	tests := []struct {
+		name   string
+		header []string
+		status int
+	}{
+		{"If-Match match", []string{"If-Match", etag}, http.StatusOK},
+		{"If-Match in a list", []string{"If-Match", `"other", ` + etag}, http.StatusOK},
+		{"If-Match mismatch", []string{"If-Match", `"other"`}, http.StatusPreconditionFailed},
+		{"If-Match *", []string{"If-Match", "*"}, http.StatusOK},
+		{"If-Match weak", []string{"If-Match", "W/" + etag}, http.StatusPreconditionFailed},
+		{"If-Unmodified-Since after mtime", []string{"If-Unmodified-Since", file.modified.Add(time.Hour).Format(http.TimeFormat)}, http.StatusOK},
+		{"If-Unmodified-Since at mtime", []string{"If-Unmodified-Since", file.modified.Format(http.TimeFormat)}, http.StatusOK},
+		{"If-Unmodified-Since before mtime", []string{"If-Unmodified-Since", file.modified.Add(-time.Hour).Format(http.TimeFormat)}, http.StatusPreconditionFailed},
+		//If-Match wins, If-Unmodified-Since is then ignored (RFC 7232 3.4)
+		{"If-Match with an old If-Unmodified-Since", []string{"If-Match", etag, "If-Unmodified-Since", file.modified.Add(-time.Hour).Format(http.TimeFormat)}, http.StatusOK},
+	}
+	for _, streamed := range []bool{false, true} {
+		for _, tt := range tests {
+			name := "cached/" + tt.name
+			if streamed {
+				name = "streamed/" + tt.name
+			}
+			t.Run(name, func(t *testing.T) {
+				if streamed {
+					defer func(n int64) { maxCacheSize = n }(maxCacheSize)
+					maxCacheSize = 4
+				}
+				h := testHandler(t, fake)
+				w := request(h, "GET", "/f.bin", tt.header...)
+				if w.Code != tt.status {
+					t.Fatalf("= %d, want %d", w.Code, tt.status)
+				}
+				if tt.status == http.StatusOK && w.Body.String() != "0123456789" {
+					t.Errorf("body %q, want the file", w.Body.String())
+				}
+				if tt.status == http.StatusPreconditionFailed && w.Body.Len() != 0 {
+					t.Errorf("412 with body %q", w.Body.String())
+				}
+			})
+		}
+	}
+}
+
+//An empty file is served without a download, and is not a 404
+func TestEmptyFile(t *testing.T) {
+	fake := newFakeDropbox()
+	file := fake.put("/Public/empty.json", "")
+	h := testHandler(t, fake)
+	w := request(h, "GET", "/empty.json")
+	if w.Code != http.StatusOK || w.Body.Len() != 0 {
+		t.Fatalf("GET = %d %q, want an empty 200", w.Code, w.Body.String())
+	}
+	if w.Header().Get("Content-Length") != "0" {
+		t.Errorf("Content-Length %q, want 0", w.Header().Get("Content-Length"))
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Content-Type %q, want application/json", ct)
+	}
+	if w := request(h, "HEAD", "/empty.json"); w.Code != http.StatusOK || w.Header().Get("Content-Length") != "0" {
+		t.Errorf("HEAD = %d Content-Length %q, want 200 0", w.Code, w.Header().Get("Content-Length"))
+	}
+	etag := `"` + file.rev + `"`
+	if w := request(h, "GET", "/empty.json", "If-None-Match", etag); w.Code != http.StatusNotModified {
+		t.Errorf("If-None-Match = %d, want 304", w.Code)
+	}
+	if w := request(h, "GET", "/empty.json", "If-Modified-Since", file.modified.Format(http.TimeFormat)); w.Code != http.StatusNotModified {
+		t.Errorf("If-Modified-Since = %d, want 304", w.Code)
+	}
+	if w := request(h, "GET", "/empty.json", "If-Match", `"other"`); w.Code != http.StatusPreconditionFailed {
+		t.Errorf("If-Match mismatch = %d, want 412", w.Code)
+	}
+	if n := fake.count("download"); n != 0 {
+		t.Errorf("%d downloads, want none", n)
+	}
+	if n := fake.count("get_metadata /public/empty.json"); n != 1 {
+		t.Errorf("%d get_metadata calls, want 1, the rest are cache hits", n)
+	}
+}
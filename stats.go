@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	cacheHits    int64 //Served from cache, accessed atomically
+	cacheMisses  int64 //Had to go to Dropbox, accessed atomically
+	recentErrors = &errorRing{max: 20}
+	statusPage   = false //Serve the /status dashboard
+)
+
+//errorRing keeps the last few errors for the status page
+type errorRing struct {
+	sync.Mutex
+	max  int
+	errs []string
+}
+
+func (e *errorRing) add(err error) {
+	e.Lock()
+	defer e.Unlock()
+	e.errs = append(e.errs, time.Now().Format(time.RFC3339)+" "+err.Error())
+	if len(e.errs) > e.max {
+		e.errs = e.errs[len(e.errs)-e.max:]
+	}
+}
+
+func (e *errorRing) list() []string {
+	e.Lock()
+	defer e.Unlock()
+	out := make([]string, len(e.errs))
+	//Newest first
+	for i, s := range e.errs {
+		out[len(e.errs)-1-i] = s
+	}
+	return out
+}
+
+//stats returns the number of cached entries and their total body size
+func (c *cache) stats() (entries int, bytes int64) {
+	c.RLock()
+	defer c.RUnlock()
+	return len(c.data), c.bytes
+}
+
+var statusTmpl = template.Must(template.New("status").Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><meta http-equiv="refresh" content="10"><title>dboxserver status</title>
+<style>body{font-family:sans-serif;margin:2em}td{padding:2px 1em 2px 0}.bad{color:#b00}.ok{color:#080}</style>
+</head><body>
+<h1>dboxserver status</h1>
+<table>
+<tr><td>Health</td><td>{{if .Problems}}<span class="bad">unhealthy</span><ul>{{range .Problems}}<li>{{.}}</li>{{end}}</ul>{{else}}<span class="ok">ok</span>{{end}}</td></tr>
+<tr><td>Cache hit rate</td><td>{{.HitRate}} ({{.Hits}} hits, {{.Misses}} misses)</td></tr>
+<tr><td>Cached entries</td><td>{{.Entries}} ({{.Bytes}} bytes)</td></tr>
+<tr><td>Heap in use</td><td>{{.Heap}} bytes</td></tr>
+<tr><td>Last invalidation</td><td>{{.LastInvalidation}} ago</td></tr>
+<tr><td>Last successful longpoll</td><td>{{.LastLongpoll}} ago{{if .LongpollFailures}} ({{.LongpollFailures}} failures since){{end}}</td></tr>
+</table>
+<h2>Recent errors</h2>
+{{if .Errors}}<ul>{{range .Errors}}<li>{{.}}</li>{{end}}</ul>{{else}}<p>None</p>{{end}}
+</body></html>
+`))
+
+func statusHandler(w http.ResponseWriter, r *http.Request) {
+	if adminToken != "" && !adminAuthorized(r) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="status"`)
+		httpError(w, r, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	hits, misses := atomic.LoadInt64(&cacheHits), atomic.LoadInt64(&cacheMisses)
+	rate := "n/a"
+	if hits+misses > 0 {
+		rate = fmt.Sprintf("%.1f%%", 100*float64(hits)/float64(hits+misses))
+	}
+	entries, bytes := dbcache.stats()
+	lastLongpoll, longpollFailures := health.longpollStatus()
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	statusTmpl.Execute(w, map[string]interface{}{
+		"Problems":         health.problems(),
+		"HitRate":          rate,
+		"Hits":             hits,
+		"Misses":           misses,
+		"Entries":          entries,
+		"Bytes":            bytes,
+		"Heap":             ms.HeapAlloc,
+		"LastInvalidation": time.Since(lastInvalidation()).Round(time.Second),
+		"LastLongpoll":     time.Since(lastLongpoll).Round(time.Second),
+		"LongpollFailures": longpollFailures,
+		"Errors":           recentErrors.list(),
+	})
+}
+
+//classStats returns the cached body bytes per content type class
+func (c *cache) classStats() map[string]int64 {
+	c.RLock()
+	defer c.RUnlock()
+	out := make(map[string]int64, len(c.classBytes))
+	for class, n := range c.classBytes {
+		out[class] = n
+	}
+	return out
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dropbox/dropbox-sdk-go-unofficial/dropbox/files"
+)
+
+var (
+	suggest        = false //Suggest similarly named files on 404
+	maxSuggestions = 5
+	maxListedDirs  = 1000 //Directory listings kept for suggestions, more start over
+	dirNames       = &dirCache{dirs: make(map[string]*dirList)}
+)
+
+//dirCache keeps the entry names of directories for suggestFor, so a burst of
+//404s in one directory (a scanner, a broken deploy) lists it once
+type dirCache struct {
+	sync.Mutex
+	dirs map[string]*dirList //By lower case url path ending in /
+}
+
+type dirList struct {
+	done    chan struct{} //Closed once names and err are set
+	names   []string
+	err     error
+	fetched time.Time
+}
+
+//stale reports whether l must be listed again: it failed, predates the last
+//invalidation or is older than negativeTTL, like the 404s it is for
+func (l *dirList) stale() bool {
+	return l.err != nil || l.fetched.Before(lastInvalidation()) || (negativeTTL > 0 && time.Since(l.fetched) > negativeTTL)
+}
+
+//get returns the names in dir, listing it unless that is cached or already
+//running
+func (c *dirCache) get(dir string) ([]string, error) {
+	k := strings.ToLower(dir)
+	c.Lock()
+	l, ok := c.dirs[k]
+	if ok {
+		select {
+		case <-l.done:
+			ok = !l.stale()
+		default:
+			//Being listed, wait for it
+		}
+	}
+	if !ok {
+		if len(c.dirs) >= maxListedDirs {
+			c.dirs = make(map[string]*dirList)
+		}
+		l = &dirList{done: make(chan struct{}), fetched: time.Now()}
+		c.dirs[k] = l
+		c.Unlock()
+		l.names, l.err = listDir(dir)
+		close(l.done)
+		return l.names, l.err
+	}
+	c.Unlock()
+	<-l.done
+	return l.names, l.err
+}
+
+//purge drops the listings of the directories containing paths (url keys that
+//changed), and of anything below them in case a folder went away
+func (c *dirCache) purge(paths map[string]bool) {
+	c.Lock()
+	defer c.Unlock()
+	for p := range paths {
+		p = strings.ToLower(p)
+		dir := path.Dir(p)
+		if dir != "/" {
+			dir += "/"
+		}
+		delete(c.dirs, dir)
+		for k := range c.dirs {
+			if strings.HasPrefix(k, p+"/") {
+				delete(c.dirs, k)
+			}
+		}
+	}
+}
+
+//suggestFor lists the parent directory of key and returns paths of entries
+//whose names are close (by edit distance) to the requested name. Denied and
+//protected paths are never suggested, the 404 is cached for everyone.
+func suggestFor(key string) []string {
+	dir, name := path.Split(key)
+	entries, err := dirNames.get(dir)
+	if err != nil {
+		logln(levelWarn, "Suggestions for", key+":", err)
+		return nil
+	}
+	type match struct {
+		name string
+		dist int
+	}
+	var matches []match
+	lname := strings.ToLower(name)
+	maxdist := len(name) / 3
+	if maxdist < 2 {
+		maxdist = 2
+	}
+	for _, e := range entries {
+		if deniedBy(dir+e) != nil || protected(dir+e) {
+			continue
+		}
+		d := levenshtein(lname, strings.ToLower(e))
+		if d <= maxdist {
+			matches = append(matches, match{e, d})
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].dist == matches[j].dist {
+			return matches[i].name < matches[j].name
+		}
+		return matches[i].dist < matches[j].dist
+	})
+	var out []string
+	for i := 0; i < len(matches) && i < maxSuggestions; i++ {
+		out = append(out, dir+matches[i].name)
+	}
+	return out
+}
+
+//listDir returns the names of the entries in dir (a url path ending in /)
+func listDir(dir string) ([]string, error) {
+	p := strings.TrimSuffix(dropboxPath(dir), "/")
+	var res *files.ListFolderResult
+	err := upstream(context.Background(), func() (err error) {
+		res, err = db.ListFolder(files.NewListFolderArg(p))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for {
+		for _, e := range res.Entries {
+			switch m := e.(type) {
+			case *files.FileMetadata:
+				names = append(names, m.Name)
+			case *files.FolderMetadata:
+				names = append(names, m.Name+"/")
+			}
+		}
+		if !res.HasMore {
+			return names, nil
+		}
+		cursor := res.Cursor
+		err = upstream(context.Background(), func() (err error) {
+			res, err = db.ListFolderContinue(files.NewListFolderContinueArg(cursor))
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+//levenshtein returns the edit distance between a and b
+func levenshtein(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = min3(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(rb)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
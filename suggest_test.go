@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"regexp"
+	"testing"
+)
+
+func TestSuggestions(t *testing.T) {
+	defer func(s bool, deny []*regexp.Regexp, rules []accessRule) {
+		suggest, denyPatterns, accessRules = s, deny, rules
+	}(suggest, denyPatterns, accessRules)
+	suggest = true
+	if err := setDenyPatterns(true, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := parseAccessRules([]string{"/docs/secret.txt=user:pass"}); err != nil {
+		t.Fatal(err)
+	}
+	fake := newFakeDropbox()
+	fake.put("/Public/docs/report.txt", "")
+	fake.put("/Public/docs/report.php", "")
+	fake.put("/Public/docs/secret.txt", "")
+	h := testHandler(t, fake)
+	suggestions := func(target string) []string {
+		w := request(h, "GET", target, "Accept", "application/json")
+		var e errorBody
+		if err := json.Unmarshal(w.Body.Bytes(), &e); err != nil || w.Code != 404 {
+			t.Fatalf("GET %s = %d %q", target, w.Code, w.Body.String())
+		}
+		return e.Suggestions
+	}
+	if got, want := suggestions("/docs/reprt.txt"), []string{"/docs/report.txt"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("suggestions %q, want %q without the denied .php", got, want)
+	}
+	if got := suggestions("/docs/secrat.txt"); len(got) != 0 {
+		t.Errorf("suggestions %q, want none, secret.txt is protected", got)
+	}
+	if n := fake.count("list_folder /public/docs"); n != 1 {
+		t.Errorf("%d listings of /docs/, want 1 for both 404s", n)
+	}
+	dirNames.purge(map[string]bool{"/docs/new.txt": true})
+	suggestions("/docs/other.txt")
+	if n := fake.count("list_folder /public/docs"); n != 2 {
+		t.Errorf("%d listings of /docs/ after a change in it, want 2", n)
+	}
+}
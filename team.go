@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/dropbox/dropbox-sdk-go-unofficial/dropbox/auth"
+	"github.com/dropbox/dropbox-sdk-go-unofficial/dropbox/files"
+	"golang.org/x/oauth2"
+)
+
+var (
+	asMember string //-as-member, team member id to act as with a team app
+	pathRoot string //-path-root, Dropbox-API-Path-Root to resolve paths against
+)
+
+//pathRootHeader turns -path-root (home, root:<namespace id> or
+//namespace:<namespace id>) into the Dropbox-API-Path-Root header value
+func pathRootHeader(s string) (string, error) {
+	var v map[string]string
+	kv := strings.SplitN(s, ":", 2)
+	switch {
+	case s == "home":
+		v = map[string]string{".tag": "home"}
+	case len(kv) == 2 && kv[0] == "root" && kv[1] != "":
+		v = map[string]string{".tag": "root", "root": kv[1]}
+	case len(kv) == 2 && kv[0] == "namespace" && kv[1] != "":
+		v = map[string]string{".tag": "namespace_id", "namespace_id": kv[1]}
+	default:
+		return "", fmt.Errorf("invalid -path-root %q, want home, root:<namespace id> or namespace:<namespace id>", s)
+	}
+	b, err := json.Marshal(v)
+	return string(b), err
+}
+
+//checkFolders makes sure the credentials work and every served folder exists,
+//so a missing or revoked token or a wrong -folder, -path-root or -as-member is
+//a clear error at startup instead of failing every request. Other errors are
+//only logged, Dropbox may just be unreachable, unless strict (-check).
+func checkFolders(strict bool) {
+	for _, f := range watchedFolders() {
+		var err error
+		if f == "" {
+			//GetMetadata doesn't support the root, the cheapest call that does
+			_, err = db.ListFolderGetLatestCursor(files.NewListFolderArg(f))
+		} else {
+			_, err = db.GetMetadata(files.NewGetMetadataArg(f))
+		}
+		if isNotFound(err) {
+			log.Fatalf("Folder %q not found in Dropbox, check -folder/-mount (and -path-root and -as-member for team accounts)", f)
+		}
+		var re *oauth2.RetrieveError
+		if _, ok := err.(auth.AuthAPIError); ok || errors.As(err, &re) {
+			log.Fatalf("Dropbox rejected the credentials (%v). Check ACCESS_TOKEN, or REFRESH_TOKEN with CLIENT_ID and CLIENT_SECRET, and that the app has the files.content.read permission", err)
+		}
+		if err != nil && strict {
+			log.Fatalf("Checking folder %q failed: %v", f, err)
+		}
+		if err != nil {
+			logln(levelWarn, "Checking folder", f, "failed:", err)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dropbox/dropbox-sdk-go-unofficial/dropbox/files"
+)
+
+var (
+	tempLinkAbove int64              //-temp-link-above, files bigger than this are redirected to Dropbox, 0 never
+	tempLinkTTL   = 30 * time.Minute //How long we hand out a link, Dropbox's are valid for 4 hours
+)
+
+type tempLink struct {
+	url     string
+	expires time.Time
+}
+
+//tempLinks are the temporary links handed out recently, by path and rev so a new
+//version of the file gets a new link
+var tempLinks = struct {
+	sync.Mutex
+	m map[string]tempLink
+}{m: make(map[string]tempLink)}
+
+//temporaryLink returns a Dropbox temporary download link for the rev of key
+func temporaryLink(ctx context.Context, key, rev string) (string, error) {
+	id := strings.ToLower(key) + "@" + rev
+	tempLinks.Lock()
+	l, ok := tempLinks.m[id]
+	tempLinks.Unlock()
+	if ok && time.Now().Before(l.expires) {
+		return l.url, nil
+	}
+	start := time.Now()
+	var res *files.GetTemporaryLinkResult
+	err := upstream(ctx, func() (err error) {
+		res, err = db.GetTemporaryLink(files.NewGetTemporaryLinkArg(dropboxPath(key)))
+		return err
+	})
+	dropboxStats.observe("get_temporary_link", start, err)
+	if err != nil {
+		recentErrors.add(err)
+		return "", err
+	}
+	tempLinks.Lock()
+	defer tempLinks.Unlock()
+	now := time.Now()
+	for k, v := range tempLinks.m {
+		if now.After(v.expires) {
+			delete(tempLinks.m, k)
+		}
+	}
+	tempLinks.m[id] = tempLink{url: res.Link, expires: now.Add(tempLinkTTL)}
+	return res.Link, nil
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/dropbox/dropbox-sdk-go-unofficial/dropbox"
+	"github.com/dropbox/dropbox-sdk-go-unofficial/dropbox/files"
+)
+
+var thumbnails = false //Serve Dropbox generated thumbnails for ?thumb=<size> on images
+
+//Sizes the Dropbox thumbnail API supports
+var thumbSizes = map[string]bool{
+	files.ThumbnailSizeW32h32:     true,
+	files.ThumbnailSizeW64h64:     true,
+	files.ThumbnailSizeW128h128:   true,
+	files.ThumbnailSizeW256h256:   true,
+	files.ThumbnailSizeW480h320:   true,
+	files.ThumbnailSizeW640h480:   true,
+	files.ThumbnailSizeW960h640:   true,
+	files.ThumbnailSizeW1024h768:  true,
+	files.ThumbnailSizeW2048h1536: true,
+}
+
+//thumbnailable reports whether Dropbox can make thumbnails of key. It can't for
+//vector images.
+func thumbnailable(key string) bool {
+	ct := contentTypeFor(key)
+	return strings.HasPrefix(ct, "image/") && ct != "image/svg+xml"
+}
+
+//dbhandlerThumb serves a thumbnail of the image key, cached under its own key
+func dbhandlerThumb(w http.ResponseWriter, r *http.Request, key, size string) {
+	size = strings.ToLower(size)
+	if !thumbSizes[size] {
+		httpError(w, r, "Unsupported thumbnail size, use one of w32h32, w64h64, w128h128, w256h256, w480h320, w640h480, w960h640, w1024h768 or w2048h1536", http.StatusBadRequest)
+		return
+	}
+	//A query string so longpoll invalidation of key purges its thumbnails too
+	ck := cachePath(key) + "?thumb=" + size
+	obj, err := dbcache.Get(ck)
+	if err == nil && !obj.stale() {
+		atomic.AddInt64(&cacheHits, 1)
+		setCacheStatus(r, "hit")
+		dbhandlerServe(w, r, obj)
+		return
+	}
+	atomic.AddInt64(&cacheMisses, 1)
+	setCacheStatus(r, "miss")
+	res, err := fills.do(r, ck, func(ctx context.Context) (fetchResult, error) {
+		return fetchThumb(ctx, r, key, size, ck)
+	})
+	if err != nil {
+		upstreamError(w, r, err)
+		return
+	}
+	dbhandlerServe(w, r, res.obj)
+}
+
+//fetchThumb gets a thumbnail from Dropbox and caches it under ck
+func fetchThumb(ctx context.Context, r *http.Request, key, size, ck string) (fetchResult, error) {
+	release, err := acquireUpstream(ctx)
+	if err != nil {
+		return fetchResult{}, err
+	}
+	defer release()
+	format := files.ThumbnailFormatJpeg
+	if ct := contentTypeFor(key); ct == "image/png" || ct == "image/gif" {
+		//Keep transparency
+		format = files.ThumbnailFormatPng
+	}
+	arg := files.NewThumbnailArg(dropboxPath(key))
+	arg.Size = &files.ThumbnailSize{Tagged: dropbox.Tagged{Tag: size}}
+	arg.Format = &files.ThumbnailFormat{Tagged: dropbox.Tagged{Tag: format}}
+	start := time.Now()
+	var entry *files.FileMetadata
+	var data []byte
+	err = retryRateLimited(func() error {
+		var rd io.ReadCloser
+		var err error
+		entry, rd, err = db.GetThumbnail(arg)
+		if err != nil {
+			return err
+		}
+		defer rd.Close()
+		stop := closeOnDone(ctx, rd)
+		defer stop()
+		data, err = ioutil.ReadAll(rd)
+		return err
+	})
+	track(r, "thumbnail", start)
+	dropboxStats.observe("get_thumbnail", start, err)
+	if err != nil {
+		if te, ok := err.(files.GetThumbnailAPIError); ok && te.EndpointError != nil && te.EndpointError.Path != nil && te.EndpointError.Path.Tag == files.LookupErrorNotFound {
+			release()
+			//Under ck too, the next thumbnail request looks there and must not ask again
+			obj := notFound(r, key, start)
+			dbcache.Set(ck, obj)
+			return fetchResult{obj: obj}, nil
+		}
+		recentErrors.add(err)
+		return fetchResult{}, err
+	}
+	obj := &cacheobj{
+		data:        data,
+		lastFetch:   start,
+		exists:      true,
+		entry:       entry,
+		contentType: "image/" + format,
+	}
+	dbcache.Set(ck, obj)
+	return fetchResult{obj: obj}, nil
+}
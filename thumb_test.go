@@ -0,0 +1,26 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+//The 404 of a missing image is cached for its thumbnails too
+func TestThumbNotFoundCached(t *testing.T) {
+	defer func(on bool) { thumbnails = on }(thumbnails)
+	thumbnails = true
+	fake := newFakeDropbox()
+	h := testHandler(t, fake)
+	for i := 0; i < 3; i++ {
+		if w := request(h, "GET", "/missing.jpg?thumb=w64h64"); w.Code != http.StatusNotFound {
+			t.Fatalf("GET %d = %d, want 404", i+1, w.Code)
+		}
+	}
+	if n := fake.count("get_thumbnail /public/missing.jpg"); n != 1 {
+		t.Errorf("%d get_thumbnail calls, want 1, the rest are negative cache hits", n)
+	}
+	//And for the image itself
+	if w := request(h, "GET", "/missing.jpg"); w.Code != http.StatusNotFound || fake.count("get_metadata /public/missing.jpg") != 0 {
+		t.Errorf("GET image = %d after %d get_metadata calls, want a cached 404", w.Code, fake.count("get_metadata /public/missing.jpg"))
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+var serverTiming = false //Emit Server-Timing headers
+
+type timingKey struct{}
+
+//timings collects durations of the phases of a request for the Server-Timing header
+type timings struct {
+	sync.Mutex
+	metrics []string
+}
+
+//withTimings attaches a timings collector to the request if -server-timing is enabled
+func withTimings(r *http.Request) *http.Request {
+	if !serverTiming {
+		return r
+	}
+	return r.WithContext(context.WithValue(r.Context(), timingKey{}, &timings{}))
+}
+
+//track records the time since start under name. Safe to call when timings are disabled.
+func track(r *http.Request, name string, start time.Time) {
+	t, ok := r.Context().Value(timingKey{}).(*timings)
+	if !ok {
+		return
+	}
+	d := time.Since(start)
+	t.Lock()
+	t.metrics = append(t.metrics, fmt.Sprintf("%s;dur=%.3f", name, float64(d)/float64(time.Millisecond)))
+	t.Unlock()
+}
+
+//writeTimings sets the Server-Timing header, must be called before the header is written.
+//Compression happens in gziphandler after this, so it is not included.
+func writeTimings(w http.ResponseWriter, r *http.Request) {
+	t, ok := r.Context().Value(timingKey{}).(*timings)
+	if !ok {
+		return
+	}
+	t.Lock()
+	defer t.Unlock()
+	if len(t.metrics) > 0 {
+		w.Header().Set("Server-Timing", strings.Join(t.metrics, ", "))
+	}
+}
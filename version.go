@@ -0,0 +1,27 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime"
+)
+
+//Set at build time, see README
+var (
+	version   = "dev"
+	commit    = ""
+	buildDate = ""
+)
+
+var versionPage = false //-version-page, serve /version instead of the Dropbox file of that name
+
+func versionHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	json.NewEncoder(w).Encode(map[string]string{
+		"version":    version,
+		"commit":     commit,
+		"build_date": buildDate,
+		"go":         runtime.Version(),
+	})
+}